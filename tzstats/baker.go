@@ -173,6 +173,11 @@ func (p BakerParams) WithMeta() BakerParams {
 	return p
 }
 
+func (p BakerParams) WithStats() BakerParams {
+	p.Query.Set("stats", "1")
+	return p
+}
+
 func (c *Client) GetBaker(ctx context.Context, addr tezos.Address, params BakerParams) (*Baker, error) {
 	b := &Baker{}
 	u := params.AppendQuery(fmt.Sprintf("/explorer/bakers/%s", addr))
@@ -0,0 +1,166 @@
+// Copyright (c) 2020-2023 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package tzstats
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"blockwatch.cc/tzgo/tezos"
+)
+
+// BalanceSnapshot is the spendable balance of an account at the end of a
+// block in which at least one balance flow touched the account.
+type BalanceSnapshot struct {
+	Height   int64     `json:"height"`
+	Cycle    int64     `json:"cycle"`
+	Time     time.Time `json:"time"`
+	Balance  float64   `json:"balance"`
+	Received float64   `json:"received"`
+	Sent     float64   `json:"sent"`
+	Fees     float64   `json:"fees"`
+	Burned   float64   `json:"burned"`
+	Rewards  float64   `json:"rewards"`
+	NFlows   int       `json:"n_flows"`
+}
+
+type BalanceHistory struct {
+	Address   tezos.Address     `json:"address"`
+	Snapshots []BalanceSnapshot `json:"snapshots"`
+	Balance   float64           `json:"balance"`  // reconstructed from flows
+	Expected  float64           `json:"expected"` // current account balance
+}
+
+// IsConsistent reports whether the reconstructed balance matches the
+// current spendable balance of the account.
+func (h BalanceHistory) IsConsistent() bool {
+	return toMutez(h.Balance) == toMutez(h.Expected)
+}
+
+// Diff returns the difference between reconstructed and expected balance.
+func (h BalanceHistory) Diff() float64 {
+	return fromMutez(toMutez(h.Balance) - toMutez(h.Expected))
+}
+
+// AsOf returns the last snapshot at or before height.
+func (h BalanceHistory) AsOf(height int64) (BalanceSnapshot, bool) {
+	var (
+		s  BalanceSnapshot
+		ok bool
+	)
+	for _, v := range h.Snapshots {
+		if v.Height > height {
+			break
+		}
+		s, ok = v, true
+	}
+	return s, ok
+}
+
+// flow types counted as rewards when credited to an account
+var balanceRewardTypes = map[OpType]bool{
+	OpTypeBake:              true,
+	OpTypeBonus:             true,
+	OpTypeReward:            true,
+	OpTypeEndorsement:       true,
+	OpTypeNonceRevelation:   true,
+	OpTypeVdfRevelation:     true,
+	OpTypeDoubleBaking:      true,
+	OpTypeDoubleEndorsement: true,
+	OpTypeSubsidy:           true,
+}
+
+// GetBalanceHistory reconstructs the spendable balance history of addr by
+// walking all balance flows in chain order. Amounts are accumulated in mutez
+// to avoid rounding drift. The result is checked against the current account
+// balance, use IsConsistent to find out whether the reconstruction is exact.
+func (c *Client) GetBalanceHistory(ctx context.Context, addr tezos.Address) (*BalanceHistory, error) {
+	acc, err := c.GetAccount(ctx, addr, NewAccountParams())
+	if err != nil {
+		return nil, err
+	}
+
+	hist := &BalanceHistory{
+		Address:   addr,
+		Snapshots: make([]BalanceSnapshot, 0),
+		Expected:  acc.SpendableBalance,
+	}
+
+	q := c.NewFlowQuery()
+	q.WithFilter(FilterModeEqual, "address", addr.String())
+	q.WithFilter(FilterModeEqual, "kind", string(FlowKindBalance))
+
+	var (
+		balance int64
+		snap    *BalanceSnapshot
+		in, out int64
+		fees    int64
+		burned  int64
+		rewards int64
+	)
+	flush := func() {
+		if snap == nil {
+			return
+		}
+		snap.Balance = fromMutez(balance)
+		snap.Received = fromMutez(in)
+		snap.Sent = fromMutez(out)
+		snap.Fees = fromMutez(fees)
+		snap.Burned = fromMutez(burned)
+		snap.Rewards = fromMutez(rewards)
+		hist.Snapshots = append(hist.Snapshots, *snap)
+		snap = nil
+		in, out, fees, burned, rewards = 0, 0, 0, 0, 0
+	}
+
+	for {
+		list, err := q.Run(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range list.Rows {
+			if snap != nil && snap.Height != f.Height {
+				flush()
+			}
+			if snap == nil {
+				snap = &BalanceSnapshot{
+					Height: f.Height,
+					Cycle:  f.Cycle,
+					Time:   f.Timestamp,
+				}
+			}
+			snap.NFlows++
+			vin, vout := toMutez(f.AmountIn), toMutez(f.AmountOut)
+			balance += vin - vout
+			in += vin
+			out += vout
+			switch {
+			case f.IsFee:
+				fees += vout
+			case f.IsBurned:
+				burned += vout
+			}
+			if vin > 0 && balanceRewardTypes[f.Type] {
+				rewards += vin
+			}
+		}
+		if list.Len() < q.Limit {
+			break
+		}
+		q.WithCursor(list.Cursor())
+	}
+	flush()
+
+	hist.Balance = fromMutez(balance)
+	return hist, nil
+}
+
+func toMutez(v float64) int64 {
+	return int64(math.Round(v * 1000000))
+}
+
+func fromMutez(v int64) float64 {
+	return float64(v) / 1000000
+}
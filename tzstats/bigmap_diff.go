@@ -0,0 +1,230 @@
+// Copyright (c) 2020-2023 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package tzstats
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+
+	"blockwatch.cc/tzgo/micheline"
+	"blockwatch.cc/tzgo/tezos"
+)
+
+type BigmapDiffKind string
+
+const (
+	BigmapDiffAdded    BigmapDiffKind = "added"
+	BigmapDiffRemoved  BigmapDiffKind = "removed"
+	BigmapDiffModified BigmapDiffKind = "modified"
+)
+
+// BigmapDiffEntry is a changed key with decoded old and new values. Old is
+// nil for added keys, New is nil for removed keys.
+type BigmapDiffEntry struct {
+	Kind BigmapDiffKind `json:"kind"`
+	Hash tezos.ExprHash `json:"hash"`
+	Key  MultiKey       `json:"key"`
+	Old  interface{}    `json:"old,omitempty"`
+	New  interface{}    `json:"new,omitempty"`
+}
+
+// BigmapDiff lists changes from bigmap From at FromHeight to bigmap To at
+// ToHeight sorted by key hash. Heights are zero when comparing current
+// state of two bigmaps.
+type BigmapDiff struct {
+	From       int64             `json:"from_bigmap"`
+	To         int64             `json:"to_bigmap"`
+	FromHeight int64             `json:"from_height,omitempty"`
+	ToHeight   int64             `json:"to_height,omitempty"`
+	Entries    []BigmapDiffEntry `json:"entries"`
+}
+
+// JSONPatchOp is a RFC 6902 JSON patch operation.
+type JSONPatchOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+func (d BigmapDiff) Len() int {
+	return len(d.Entries)
+}
+
+// Filter returns entries of the selected kind.
+func (d BigmapDiff) Filter(kind BigmapDiffKind) []BigmapDiffEntry {
+	res := make([]BigmapDiffEntry, 0)
+	for _, v := range d.Entries {
+		if v.Kind == kind {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+// JSONPatch converts the diff into JSON patch operations on an object of
+// bigmap values keyed by their string key representation.
+func (d BigmapDiff) JSONPatch() []JSONPatchOp {
+	ops := make([]JSONPatchOp, 0, len(d.Entries))
+	for _, v := range d.Entries {
+		op := JSONPatchOp{
+			Path:  "/" + jsonPointerEscape(v.Key.String()),
+			Value: v.New,
+		}
+		switch v.Kind {
+		case BigmapDiffAdded:
+			op.Op = "add"
+		case BigmapDiffRemoved:
+			op.Op = "remove"
+		case BigmapDiffModified:
+			op.Op = "replace"
+		}
+		ops = append(ops, op)
+	}
+	return ops
+}
+
+func (d BigmapDiff) WriteJSONPatch(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(d.JSONPatch())
+}
+
+func jsonPointerEscape(s string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(s)
+}
+
+// diffBigmapSnapshots compares the values of two snapshots. Keys missing in
+// a are added, keys missing in b are removed. When keys is not nil only
+// these key hashes are compared.
+func diffBigmapSnapshots(a, b *BigmapSnapshot, keys map[string]struct{}) []BigmapDiffEntry {
+	if keys == nil {
+		keys = make(map[string]struct{}, len(a.Values)+len(b.Values))
+		for k := range a.Values {
+			keys[k] = struct{}{}
+		}
+		for k := range b.Values {
+			keys[k] = struct{}{}
+		}
+	}
+	hashes := make([]string, 0, len(keys))
+	for k := range keys {
+		hashes = append(hashes, k)
+	}
+	sort.Strings(hashes)
+	entries := make([]BigmapDiffEntry, 0)
+	for _, k := range hashes {
+		old, inA := a.Values[k]
+		val, inB := b.Values[k]
+		e := BigmapDiffEntry{}
+		switch {
+		case inA && inB:
+			if equalBigmapValues(old, val) {
+				continue
+			}
+			e.Kind = BigmapDiffModified
+			e.Hash, e.Key, e.Old, e.New = val.Hash, val.Key, old.Value, val.Value
+		case inB:
+			e.Kind = BigmapDiffAdded
+			e.Hash, e.Key, e.New = val.Hash, val.Key, val.Value
+		case inA:
+			e.Kind = BigmapDiffRemoved
+			e.Hash, e.Key, e.Old = old.Hash, old.Key, old.Value
+		default:
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func equalBigmapValues(a, b BigmapValue) bool {
+	if a.ValuePrim != nil && b.ValuePrim != nil {
+		return a.ValuePrim.IsEqual(*b.ValuePrim)
+	}
+	return reflect.DeepEqual(a.Value, b.Value)
+}
+
+// DiffBigmaps compares the current content of two bigmaps, e.g. a bigmap
+// and its copy.
+func (c *Client) DiffBigmaps(ctx context.Context, from, to int64) (*BigmapDiff, error) {
+	params := NewContractParams().WithPrim()
+	a, err := c.GetBigmapSnapshot(ctx, from, params)
+	if err != nil {
+		return nil, err
+	}
+	b, err := c.GetBigmapSnapshot(ctx, to, params)
+	if err != nil {
+		return nil, err
+	}
+	return &BigmapDiff{
+		From:    from,
+		To:      to,
+		Entries: diffBigmapSnapshots(a, b, nil),
+	}, nil
+}
+
+// DiffBigmapHeights compares the content of a bigmap at two heights. When
+// keys were only updated or removed in between just these keys are
+// reverted to their state at from (see GetBigmapAt). Allocations, copies
+// and removal of the entire bigmap change keys without own updates, so
+// in this case both full states are reconstructed.
+func (c *Client) DiffBigmapHeights(ctx context.Context, id, from, to int64) (*BigmapDiff, error) {
+	if from > to {
+		from, to = to, from
+	}
+	params := NewContractParams().WithPrim()
+	upd, err := c.ListBigmapUpdatesRange(ctx, id, from, to, params)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		a, b *BigmapSnapshot
+		keys map[string]struct{}
+	)
+	if hasBigmapReset(upd) {
+		b, err = c.GetBigmapAt(ctx, id, to, nil, params)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// state of changed keys at to
+		changes := lastBigmapKeyUpdatesFrom(upd)
+		b = NewBigmapSnapshot(id, to)
+		keys = make(map[string]struct{}, len(changes))
+		for _, u := range changes {
+			keys[u.Hash.String()] = struct{}{}
+			b.Apply(u)
+		}
+		b.Height = to
+	}
+	a, err = c.GetBigmapAt(ctx, id, from, b, params)
+	if err != nil {
+		return nil, err
+	}
+	return &BigmapDiff{
+		From:       id,
+		To:         id,
+		FromHeight: from,
+		ToHeight:   to,
+		Entries:    diffBigmapSnapshots(a, b, keys),
+	}, nil
+}
+
+// hasBigmapReset reports whether updates contain allocations, copies or
+// removals of the entire bigmap.
+func hasBigmapReset(upd []BigmapUpdate) bool {
+	for _, u := range upd {
+		switch {
+		case u.Action == micheline.DiffActionAlloc,
+			u.Action == micheline.DiffActionCopy,
+			u.Action == micheline.DiffActionRemove && !u.Hash.IsValid():
+			return true
+		}
+	}
+	return false
+}
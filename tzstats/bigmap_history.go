@@ -0,0 +1,474 @@
+// Copyright (c) 2020-2023 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package tzstats
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"blockwatch.cc/tzgo/micheline"
+	"blockwatch.cc/tzgo/tezos"
+)
+
+// BigmapSnapshot is the full content of a bigmap at a height. Values are
+// keyed by key hash.
+type BigmapSnapshot struct {
+	BigmapId int64                  `json:"bigmap_id"`
+	Height   int64                  `json:"height"`
+	Values   map[string]BigmapValue `json:"values"`
+}
+
+func NewBigmapSnapshot(id, height int64) *BigmapSnapshot {
+	return &BigmapSnapshot{
+		BigmapId: id,
+		Height:   height,
+		Values:   make(map[string]BigmapValue),
+	}
+}
+
+func (s BigmapSnapshot) Len() int {
+	return len(s.Values)
+}
+
+func (s BigmapSnapshot) Get(hash tezos.ExprHash) (BigmapValue, bool) {
+	v, ok := s.Values[hash.String()]
+	return v, ok
+}
+
+// List returns all values sorted by key hash.
+func (s BigmapSnapshot) List() []BigmapValue {
+	keys := make([]string, 0, len(s.Values))
+	for k := range s.Values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	vals := make([]BigmapValue, len(keys))
+	for i, k := range keys {
+		vals[i] = s.Values[k]
+	}
+	return vals
+}
+
+func (s BigmapSnapshot) Clone() *BigmapSnapshot {
+	c := NewBigmapSnapshot(s.BigmapId, s.Height)
+	for k, v := range s.Values {
+		c.Values[k] = v
+	}
+	return c
+}
+
+// Apply applies a single update in forward direction. Copy updates
+// must be resolved by the caller.
+func (s *BigmapSnapshot) Apply(u BigmapUpdate) {
+	switch u.Action {
+	case micheline.DiffActionAlloc:
+		s.Values = make(map[string]BigmapValue)
+	case micheline.DiffActionUpdate:
+		s.Values[u.Hash.String()] = u.BigmapValue
+	case micheline.DiffActionRemove:
+		if !u.Hash.IsValid() {
+			// removal of the entire bigmap
+			s.Values = make(map[string]BigmapValue)
+		} else {
+			delete(s.Values, u.Hash.String())
+		}
+	}
+	if u.Height > s.Height {
+		s.Height = u.Height
+	}
+}
+
+// GetBigmapSnapshot loads the current content of a bigmap.
+func (c *Client) GetBigmapSnapshot(ctx context.Context, id int64, params ContractParams) (*BigmapSnapshot, error) {
+	tip, err := c.GetTip(ctx)
+	if err != nil {
+		return nil, err
+	}
+	snap := NewBigmapSnapshot(id, tip.Height)
+	params = params.WithBlock(strconv.FormatInt(tip.Height, 10)).WithLimit(DefaultPageSize)
+	var offset uint
+	for {
+		vals, err := c.ListBigmapValues(ctx, id, params.WithOffset(offset))
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range vals {
+			snap.Values[v.Hash.String()] = v
+		}
+		if uint(len(vals)) < DefaultPageSize {
+			break
+		}
+		offset += uint(len(vals))
+	}
+	return snap, nil
+}
+
+// ListBigmapUpdatesRange returns all updates of a bigmap with from < height
+// <= to in ascending order.
+func (c *Client) ListBigmapUpdatesRange(ctx context.Context, id, from, to int64, params ContractParams) ([]BigmapUpdate, error) {
+	params = params.
+		WithSince(strconv.FormatInt(from, 10)).
+		WithBlock(strconv.FormatInt(to, 10)).
+		WithOrder(OrderAsc).
+		WithLimit(DefaultPageSize)
+	res := make([]BigmapUpdate, 0)
+	var offset uint
+	for {
+		upd, err := c.ListBigmapUpdates(ctx, id, params.WithOffset(offset))
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range upd {
+			if u.Height > from && u.Height <= to {
+				res = append(res, u)
+			}
+		}
+		if uint(len(upd)) < DefaultPageSize {
+			break
+		}
+		offset += uint(len(upd))
+	}
+	return res, nil
+}
+
+// ListBigmapChanges returns the last update of each key changed between
+// heights from (exclusive) and to (inclusive) sorted by key hash.
+func (c *Client) ListBigmapChanges(ctx context.Context, id, from, to int64, params ContractParams) ([]BigmapUpdate, error) {
+	if from > to {
+		from, to = to, from
+	}
+	upd, err := c.ListBigmapUpdatesRange(ctx, id, from, to, params)
+	if err != nil {
+		return nil, err
+	}
+	return lastBigmapKeyUpdatesFrom(upd), nil
+}
+
+// lastBigmapKeyUpdatesFrom returns the last of each key's updates sorted by
+// key hash. Updates without key are skipped.
+func lastBigmapKeyUpdatesFrom(upd []BigmapUpdate) []BigmapUpdate {
+	last := make(map[string]BigmapUpdate)
+	for _, u := range upd {
+		if u.Hash.IsValid() {
+			last[u.Hash.String()] = u
+		}
+	}
+	res := make([]BigmapUpdate, 0, len(last))
+	for _, u := range last {
+		res = append(res, u)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Hash.String() < res[j].Hash.String()
+	})
+	return res
+}
+
+// GetBigmapAt reconstructs the content of a bigmap at height. Updates are
+// replayed forwards or backwards from base which defaults to the current
+// state when nil. Base is not modified.
+func (c *Client) GetBigmapAt(ctx context.Context, id, height int64, base *BigmapSnapshot, params ContractParams) (*BigmapSnapshot, error) {
+	if base == nil {
+		var err error
+		base, err = c.GetBigmapSnapshot(ctx, id, params)
+		if err != nil {
+			return nil, err
+		}
+	}
+	switch {
+	case base.Height == height:
+		return base.Clone(), nil
+	case base.Height < height:
+		return c.replayBigmapForward(ctx, base, height, params)
+	default:
+		return c.replayBigmapBackward(ctx, base, height, params)
+	}
+}
+
+func (c *Client) replayBigmapForward(ctx context.Context, base *BigmapSnapshot, height int64, params ContractParams) (*BigmapSnapshot, error) {
+	upd, err := c.ListBigmapUpdatesRange(ctx, base.BigmapId, base.Height, height, params)
+	if err != nil {
+		return nil, err
+	}
+	snap := base.Clone()
+	for _, u := range upd {
+		if u.Action == micheline.DiffActionCopy {
+			src, err := c.GetBigmapAt(ctx, u.SourceId, u.Height, nil, params)
+			if err != nil {
+				return nil, err
+			}
+			snap.Values = src.Values
+			continue
+		}
+		snap.Apply(u)
+	}
+	snap.Height = height
+	return snap, nil
+}
+
+// replayBigmapBackward reverts all keys changed after height to the value
+// of their latest update at or below height. Previous values are loaded in
+// batches from the bigmap_updates table.
+func (c *Client) replayBigmapBackward(ctx context.Context, base *BigmapSnapshot, height int64, params ContractParams) (*BigmapSnapshot, error) {
+	upd, err := c.ListBigmapUpdatesRange(ctx, base.BigmapId, height, base.Height, params)
+	if err != nil {
+		return nil, err
+	}
+	snap := base.Clone()
+	snap.Height = height
+	hashes := make([]string, 0)
+	seen := make(map[string]struct{})
+	for _, u := range upd {
+		switch {
+		case u.Action == micheline.DiffActionAlloc,
+			u.Action == micheline.DiffActionCopy,
+			u.Action == micheline.DiffActionRemove && !u.Hash.IsValid():
+			// the bigmap did not exist, had different content before
+			// (re-)allocation or was removed entirely, so rebuild from an
+			// empty state
+			return c.replayBigmapForward(ctx, NewBigmapSnapshot(base.BigmapId, 0), height, params)
+		}
+		key := u.Hash.String()
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		hashes = append(hashes, key)
+	}
+	if len(hashes) == 0 {
+		return snap, nil
+	}
+	bm, err := c.GetBigmap(ctx, base.BigmapId, NewContractParams())
+	if err != nil {
+		return nil, err
+	}
+	prev, err := c.lastBigmapKeyUpdates(ctx, base.BigmapId, hashes, height)
+	if err != nil {
+		return nil, err
+	}
+	keyType, valueType := bm.MakeKeyType(), bm.MakeValueType()
+	var missing bool
+	for _, key := range hashes {
+		r, ok := prev[key]
+		if !ok {
+			missing = true
+		}
+		if !ok || r.Action != micheline.DiffActionUpdate {
+			delete(snap.Values, key)
+			continue
+		}
+		v, err := r.decodeBigmapValue(keyType, valueType)
+		if err != nil {
+			return nil, fmt.Errorf("bigmap %d key %s: %v", base.BigmapId, key, err)
+		}
+		snap.Values[key] = v
+	}
+	if missing {
+		// keys without own history may have been copied into the bigmap
+		// on allocation, only a forward replay resolves the copy source
+		first, err := c.firstBigmapUpdate(ctx, base.BigmapId)
+		if err != nil {
+			return nil, err
+		}
+		if first != nil && first.Action == micheline.DiffActionCopy && first.Height <= height {
+			return c.replayBigmapForward(ctx, NewBigmapSnapshot(base.BigmapId, 0), height, params)
+		}
+	}
+	return snap, nil
+}
+
+// lastBigmapKeyUpdates returns the latest update at or below height for each
+// of the key hashes. Keys without update are omitted.
+func (c *Client) lastBigmapKeyUpdates(ctx context.Context, id int64, hashes []string, height int64) (map[string]*BigmapUpdateRow, error) {
+	res := make(map[string]*BigmapUpdateRow, len(hashes))
+	for len(hashes) > 0 {
+		n := len(hashes)
+		if n > DefaultPageSize {
+			n = DefaultPageSize
+		}
+		chunk := hashes[:n]
+		hashes = hashes[n:]
+		todo := make(map[string]struct{}, len(chunk))
+		for _, k := range chunk {
+			todo[k] = struct{}{}
+		}
+		q := c.NewBigmapUpdateQuery()
+		q.WithFilter(FilterModeEqual, "bigmap_id", id)
+		q.WithFilter(FilterModeIn, "hash", chunk)
+		q.WithFilter(FilterModeLte, "height", height)
+		q.WithOrder(OrderDesc)
+		for len(todo) > 0 {
+			list, err := q.Run(ctx)
+			if err != nil {
+				return nil, err
+			}
+			for _, r := range list.Rows {
+				key := r.Hash.String()
+				if _, ok := todo[key]; !ok {
+					continue
+				}
+				delete(todo, key)
+				res[key] = r
+			}
+			if list.Len() < q.Limit {
+				break
+			}
+			q.WithCursor(list.Cursor())
+		}
+	}
+	return res, nil
+}
+
+// firstBigmapUpdate returns the allocation or copy that created a bigmap.
+func (c *Client) firstBigmapUpdate(ctx context.Context, id int64) (*BigmapUpdateRow, error) {
+	q := c.NewBigmapUpdateQuery()
+	q.WithFilter(FilterModeEqual, "bigmap_id", id)
+	q.WithOrder(OrderAsc)
+	q.WithLimit(1)
+	list, err := q.Run(ctx)
+	if err != nil || list.Len() == 0 {
+		return nil, err
+	}
+	return list.Rows[0], nil
+}
+
+// decodeBigmapValue converts an update row into a bigmap value like the
+// explorer API returns it.
+func (r BigmapUpdateRow) decodeBigmapValue(keyType, valueType micheline.Type) (BigmapValue, error) {
+	k, err := r.DecodeKey(keyType)
+	if err != nil {
+		return BigmapValue{}, err
+	}
+	v, err := r.DecodeValue(valueType)
+	if err != nil {
+		return BigmapValue{}, err
+	}
+	key, err := DecodeMultiKey(k)
+	if err != nil {
+		return BigmapValue{}, err
+	}
+	val, err := v.Map()
+	if err != nil {
+		return BigmapValue{}, err
+	}
+	keyPrim, valuePrim := k.Prim(), v.Value
+	return BigmapValue{
+		Key:       key,
+		Hash:      r.Hash,
+		Value:     val,
+		Height:    r.Height,
+		Time:      r.Time,
+		KeyPrim:   &keyPrim,
+		ValuePrim: &valuePrim,
+	}, nil
+}
+
+// BigmapKeyEvent is a single change of a bigmap key. Value is nil when the
+// key was removed.
+type BigmapKeyEvent struct {
+	Height    int64                `json:"height"`
+	Time      time.Time            `json:"time"`
+	OpHash    tezos.OpHash         `json:"op"`
+	Action    micheline.DiffAction `json:"action"`
+	Value     interface{}          `json:"value,omitempty"`
+	ValuePrim *micheline.Prim      `json:"value_prim,omitempty"`
+}
+
+func (e BigmapKeyEvent) IsRemoved() bool {
+	return e.Action == micheline.DiffActionRemove
+}
+
+func (e BigmapKeyEvent) Unmarshal(val interface{}) error {
+	buf, _ := json.Marshal(e.Value)
+	return json.Unmarshal(buf, val)
+}
+
+// BigmapKeyHistory is the timeline of all changes of a bigmap key in
+// ascending order.
+type BigmapKeyHistory struct {
+	BigmapId int64            `json:"bigmap_id"`
+	Hash     tezos.ExprHash   `json:"hash"`
+	Key      MultiKey         `json:"key"`
+	Events   []BigmapKeyEvent `json:"events"`
+}
+
+// AsOf returns the last event at or below height.
+func (h BigmapKeyHistory) AsOf(height int64) (BigmapKeyEvent, bool) {
+	i := sort.Search(len(h.Events), func(i int) bool {
+		return h.Events[i].Height > height
+	})
+	if i == 0 {
+		return BigmapKeyEvent{}, false
+	}
+	return h.Events[i-1], true
+}
+
+// GetBigmapKeyHistory returns all updates of a key. The key can be given as
+// expression hash, literal value, tezos.Address, MultiKey or micheline.Key
+// and is hashed locally using the bigmap key type. Values are decoded with
+// the bigmap value type.
+func (c *Client) GetBigmapKeyHistory(ctx context.Context, id int64, key interface{}, params ContractParams) (*BigmapKeyHistory, error) {
+	bm, err := c.GetBigmap(ctx, id, NewContractParams())
+	if err != nil {
+		return nil, err
+	}
+	hash, err := bigmapKeyHash(bm.MakeKeyType(), key)
+	if err != nil {
+		return nil, fmt.Errorf("bigmap %d key %v: %v", id, key, err)
+	}
+	hist := &BigmapKeyHistory{
+		BigmapId: id,
+		Hash:     hash,
+		Events:   make([]BigmapKeyEvent, 0),
+	}
+	typ := bm.MakeValueType()
+	params = params.
+		WithPrim().
+		WithMeta().
+		WithOrder(OrderAsc).
+		WithLimit(DefaultPageSize)
+	var offset uint
+	for {
+		upd, err := c.ListBigmapKeyUpdates(ctx, id, hash.String(), params.WithOffset(offset))
+		if err != nil {
+			if ErrorStatus(err) == http.StatusNotFound {
+				break
+			}
+			return nil, err
+		}
+		for _, u := range upd {
+			if hist.Key.Len() == 0 {
+				hist.Key = u.Key
+			}
+			ev := BigmapKeyEvent{
+				Height: u.Height,
+				Time:   u.Time,
+				Action: u.Action,
+			}
+			if u.Meta != nil {
+				ev.OpHash = u.Meta.UpdateOp
+			}
+			if u.Action == micheline.DiffActionUpdate {
+				ev.Value = u.Value
+				ev.ValuePrim = u.ValuePrim
+				if u.ValuePrim != nil {
+					val := micheline.NewValue(typ, *u.ValuePrim)
+					if m, err := val.Map(); err == nil {
+						ev.Value = m
+					}
+				}
+			}
+			hist.Events = append(hist.Events, ev)
+		}
+		if uint(len(upd)) < DefaultPageSize {
+			break
+		}
+		offset += uint(len(upd))
+	}
+	return hist, nil
+}
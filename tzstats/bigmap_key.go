@@ -5,9 +5,12 @@ package tzstats
 
 import (
 	"context"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"math"
 	"math/big"
+	"reflect"
 	"strconv"
 	"strings"
 	"time"
@@ -29,6 +32,19 @@ type MultiKey struct {
 	single string
 }
 
+// NewMultiKey creates a key from a single value or from the ordered
+// elements of a pair key.
+func NewMultiKey(vals ...interface{}) MultiKey {
+	switch len(vals) {
+	case 0:
+		return MultiKey{}
+	case 1:
+		return MultiKey{single: ToString(vals[0])}
+	default:
+		return MultiKey{anon: vals}
+	}
+}
+
 func DecodeMultiKey(key micheline.Key) (MultiKey, error) {
 	mk := MultiKey{}
 	buf, err := json.Marshal(key)
@@ -102,32 +118,45 @@ func (k *MultiKey) UnmarshalJSON(buf []byte) error {
 	return nil
 }
 
+// value returns the populated key representation. Note that nil maps and
+// slices must not be passed as interface{} since they would compare non-nil.
+func (k MultiKey) value() interface{} {
+	switch {
+	case len(k.named) > 0:
+		return k.named
+	case len(k.anon) > 0:
+		return k.anon
+	default:
+		return k.single
+	}
+}
+
 func (k MultiKey) GetString(path string) (string, bool) {
-	return getPathString(nonNil(k.named, k.anon, k.single), path)
+	return getPathString(k.value(), path)
 }
 
 func (k MultiKey) GetInt64(path string) (int64, bool) {
-	return getPathInt64(nonNil(k.named, k.anon, k.single), path)
+	return getPathInt64(k.value(), path)
 }
 
 func (k MultiKey) GetBig(path string) (*big.Int, bool) {
-	return getPathBig(nonNil(k.named, k.anon, k.single), path)
+	return getPathBig(k.value(), path)
 }
 
 func (k MultiKey) GetTime(path string) (time.Time, bool) {
-	return getPathTime(nonNil(k.named, k.anon, k.single), path)
+	return getPathTime(k.value(), path)
 }
 
 func (k MultiKey) GetAddress(path string) (tezos.Address, bool) {
-	return getPathAddress(nonNil(k.named, k.anon, k.single), path)
+	return getPathAddress(k.value(), path)
 }
 
 func (k MultiKey) GetValue(path string) (interface{}, bool) {
-	return getPathValue(nonNil(k.named, k.anon, k.single), path)
+	return getPathValue(k.value(), path)
 }
 
 func (k MultiKey) Walk(path string, fn ValueWalkerFunc) error {
-	val := nonNil(k.named, k.anon, k.single)
+	val := k.value()
 	if len(path) > 0 {
 		var ok bool
 		val, ok = getPathValue(val, path)
@@ -143,6 +172,289 @@ func (k MultiKey) Unmarshal(val interface{}) error {
 	return json.Unmarshal(buf, val)
 }
 
+// Hash returns the expression hash of the key for a bigmap key type.
+func (k MultiKey) Hash(typ micheline.Type) (tezos.ExprHash, error) {
+	return BigmapKeyHash(typ, k)
+}
+
+// BigmapKeyHash packs a Go value as key of type typ and returns the
+// expression hash used for bigmap lookups. See NewBigmapKey for supported
+// values.
+func BigmapKeyHash(typ micheline.Type, val interface{}) (tezos.ExprHash, error) {
+	key, err := NewBigmapKey(typ, val)
+	if err != nil {
+		return tezos.ExprHash{}, err
+	}
+	return key.Hash(), nil
+}
+
+// NewBigmapKey converts a Go value into a key of type typ. Scalars may be
+// passed as native Go types, tzgo types or strings. Pair keys accept a
+// MultiKey, a map of field names (leaf positions for unnamed fields), a
+// flat or nested slice, a struct with JSON tags or a comma separated
+// string. Options accept nil for None. Or keys accept a single entry map
+// keyed by the branch field name.
+func NewBigmapKey(typ micheline.Type, val interface{}) (micheline.Key, error) {
+	p, err := encodeKeyPrim(typ.Prim, val)
+	if err != nil {
+		return micheline.Key{}, err
+	}
+	return micheline.NewKey(typ, p)
+}
+
+// primEncoder converts a Go value into a Michelson value of type typ.
+type primEncoder func(typ micheline.Prim, val interface{}) (micheline.Prim, error)
+
+func encodeKeyPrim(typ micheline.Prim, val interface{}) (micheline.Prim, error) {
+	if p, ok, err := encodeCompositePrim(typ, val, encodeKeyPrim); ok {
+		return p, err
+	}
+
+	// scalars are packed in optimized binary form
+	s := ToString(val)
+	switch typ.OpCode {
+	case micheline.T_INT, micheline.T_NAT, micheline.T_MUTEZ:
+		if f, ok := val.(float64); ok && f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+			s = strconv.FormatInt(int64(f), 10)
+		}
+		i, ok := new(big.Int).SetString(s, 10)
+		if !ok {
+			return micheline.Prim{}, fmt.Errorf("invalid %s key %q", typ.OpCode, s)
+		}
+		return micheline.NewBig(i), nil
+	case micheline.T_STRING:
+		return micheline.NewString(s), nil
+	case micheline.T_BYTES:
+		if b, ok := val.([]byte); ok {
+			return micheline.NewBytes(b), nil
+		}
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			return micheline.Prim{}, fmt.Errorf("invalid bytes key %q: %v", s, err)
+		}
+		return micheline.NewBytes(b), nil
+	case micheline.T_BOOL:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return micheline.Prim{}, fmt.Errorf("invalid bool key %q", s)
+		}
+		if b {
+			return micheline.NewCode(micheline.D_TRUE), nil
+		}
+		return micheline.NewCode(micheline.D_FALSE), nil
+	case micheline.T_TIMESTAMP:
+		if t, ok := val.(time.Time); ok {
+			return micheline.NewInt64(t.Unix()), nil
+		}
+		if t, err := time.Parse(time.RFC3339, s); err == nil {
+			return micheline.NewInt64(t.Unix()), nil
+		}
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return micheline.Prim{}, fmt.Errorf("invalid timestamp key %q", s)
+		}
+		return micheline.NewInt64(i), nil
+	case micheline.T_ADDRESS, micheline.T_KEY_HASH:
+		a, err := tezos.ParseAddress(s)
+		if err != nil {
+			return micheline.Prim{}, fmt.Errorf("invalid %s key %q: %v", typ.OpCode, s, err)
+		}
+		if typ.OpCode == micheline.T_KEY_HASH {
+			return micheline.NewBytes(a.Encode()), nil
+		}
+		return micheline.NewBytes(a.EncodePadded()), nil
+	case micheline.T_KEY:
+		k, err := tezos.ParseKey(s)
+		if err != nil {
+			return micheline.Prim{}, fmt.Errorf("invalid key %q: %v", s, err)
+		}
+		buf, _ := k.MarshalBinary()
+		return micheline.NewBytes(buf), nil
+	case micheline.T_SIGNATURE:
+		sig, err := tezos.ParseSignature(s)
+		if err != nil {
+			return micheline.Prim{}, fmt.Errorf("invalid signature key %q: %v", s, err)
+		}
+		buf, _ := sig.MarshalBinary()
+		return micheline.NewBytes(buf), nil
+	default:
+		return micheline.Prim{}, fmt.Errorf("unsupported key type %s", typ.OpCode)
+	}
+}
+
+// encodeCompositePrim encodes pair, option, or and unit values using enc
+// for nested values. It returns false for all other types.
+func encodeCompositePrim(typ micheline.Prim, val interface{}, enc primEncoder) (micheline.Prim, bool, error) {
+	if k, ok := val.(MultiKey); ok {
+		val = k.value()
+	}
+	switch typ.OpCode {
+	case micheline.T_PAIR:
+		vals, err := flattenKeyValue(typ, val)
+		if err != nil {
+			return micheline.Prim{}, true, err
+		}
+		p, err := buildKeyPair(typ, &vals, enc)
+		return p, true, err
+	case micheline.T_OPTION:
+		if val == nil || reflect.ValueOf(val).Kind() == reflect.Ptr && reflect.ValueOf(val).IsNil() {
+			return micheline.NewCode(micheline.D_NONE), true, nil
+		}
+		p, err := enc(typ.Args[0], reflect.Indirect(reflect.ValueOf(val)).Interface())
+		if err != nil {
+			return micheline.Prim{}, true, err
+		}
+		return micheline.NewCode(micheline.D_SOME, p), true, nil
+	case micheline.T_OR:
+		m, ok := val.(map[string]interface{})
+		if !ok || len(m) != 1 {
+			return micheline.Prim{}, true, fmt.Errorf("or value requires a single entry map, got %T", val)
+		}
+		for i, code := range []micheline.OpCode{micheline.D_LEFT, micheline.D_RIGHT} {
+			if v, ok := m[micheline.Type{Prim: typ.Args[i]}.Label()]; ok {
+				p, err := enc(typ.Args[i], v)
+				if err != nil {
+					return micheline.Prim{}, true, err
+				}
+				return micheline.NewCode(code, p), true, nil
+			}
+		}
+		return micheline.Prim{}, true, fmt.Errorf("or value %v does not match any branch", val)
+	case micheline.T_UNIT:
+		return micheline.NewCode(micheline.D_UNIT), true, nil
+	}
+	return micheline.Prim{}, false, nil
+}
+
+// keyLeaves returns the non-pair leaf types of a pair type in order.
+func keyLeaves(typ micheline.Prim) []micheline.Prim {
+	if typ.OpCode != micheline.T_PAIR {
+		return []micheline.Prim{typ}
+	}
+	leaves := make([]micheline.Prim, 0, len(typ.Args))
+	for _, v := range typ.Args {
+		leaves = append(leaves, keyLeaves(v)...)
+	}
+	return leaves
+}
+
+// flattenKeyValue converts a pair key value into a list of leaf values.
+func flattenKeyValue(typ micheline.Prim, val interface{}) ([]interface{}, error) {
+	if typ.OpCode != micheline.T_PAIR {
+		return []interface{}{val}, nil
+	}
+	leaves := keyLeaves(typ)
+	if s, ok := val.(string); ok {
+		val = strings.Split(s, ",")
+	}
+	rv := reflect.Indirect(reflect.ValueOf(val))
+	switch rv.Kind() {
+	case reflect.Struct:
+		buf, err := json.Marshal(val)
+		if err != nil {
+			return nil, err
+		}
+		m := make(map[string]interface{})
+		if err := json.Unmarshal(buf, &m); err != nil {
+			return nil, err
+		}
+		return flattenKeyValue(typ, m)
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("unsupported pair key map %T, want string keys", val)
+		}
+		vals := make([]interface{}, len(leaves))
+		for i, l := range leaves {
+			// unnamed fields use their position like DecodeMultiKey
+			label := typeLabel(micheline.NewType(l), i)
+			v := rv.MapIndex(reflect.ValueOf(label).Convert(rv.Type().Key()))
+			if !v.IsValid() {
+				return nil, fmt.Errorf("missing key field %q", label)
+			}
+			vals[i] = v.Interface()
+		}
+		return vals, nil
+	case reflect.Slice, reflect.Array:
+		vals := make([]interface{}, rv.Len())
+		for i := range vals {
+			vals[i] = rv.Index(i).Interface()
+		}
+		switch len(vals) {
+		case len(leaves):
+			return vals, nil
+		case len(typ.Args):
+			flat := make([]interface{}, 0, len(leaves))
+			for i, v := range vals {
+				f, err := flattenKeyValue(typ.Args[i], v)
+				if err != nil {
+					return nil, err
+				}
+				flat = append(flat, f...)
+			}
+			return flat, nil
+		}
+		return nil, fmt.Errorf("pair key requires %d values, got %d", len(leaves), len(vals))
+	default:
+		return nil, fmt.Errorf("unsupported pair key value %T", val)
+	}
+}
+
+// buildKeyPair consumes leaf values and builds a right-nested pair tree.
+func buildKeyPair(typ micheline.Prim, vals *[]interface{}, enc primEncoder) (micheline.Prim, error) {
+	if typ.OpCode != micheline.T_PAIR {
+		if len(*vals) == 0 {
+			return micheline.Prim{}, fmt.Errorf("missing pair key value")
+		}
+		v := (*vals)[0]
+		*vals = (*vals)[1:]
+		return enc(typ, v)
+	}
+	args := make([]micheline.Prim, len(typ.Args))
+	for i, t := range typ.Args {
+		p, err := buildKeyPair(t, vals, enc)
+		if err != nil {
+			return micheline.Prim{}, err
+		}
+		args[i] = p
+	}
+	p := args[len(args)-1]
+	for i := len(args) - 2; i >= 0; i-- {
+		p = micheline.NewPair(args[i], p)
+	}
+	return p, nil
+}
+
+// bigmapKeyHash resolves the expression hash of a key given as expression
+// hash, micheline.Key or Go value.
+func bigmapKeyHash(typ micheline.Type, key interface{}) (tezos.ExprHash, error) {
+	switch k := key.(type) {
+	case tezos.ExprHash:
+		return k, nil
+	case micheline.Key:
+		return k.Hash(), nil
+	case string:
+		if h, err := tezos.ParseExprHash(k); err == nil {
+			return h, nil
+		}
+	}
+	return BigmapKeyHash(typ, key)
+}
+
+// KeyHash returns the expression hash of a key value for this bigmap.
+func (b Bigmap) KeyHash(val interface{}) (tezos.ExprHash, error) {
+	return BigmapKeyHash(b.MakeKeyType(), val)
+}
+
+// GetBigmapValueByKey looks up a value by a Go key value which is hashed
+// locally using the bigmap key type.
+func (c *Client) GetBigmapValueByKey(ctx context.Context, b Bigmap, key interface{}, params ContractParams) (*BigmapValue, error) {
+	hash, err := bigmapKeyHash(b.MakeKeyType(), key)
+	if err != nil {
+		return nil, fmt.Errorf("bigmap %d key %v: %v", b.BigmapId, key, err)
+	}
+	return c.GetBigmapValue(ctx, b.BigmapId, hash.String(), params)
+}
+
 func (c *Client) ListBigmapKeys(ctx context.Context, id int64, params ContractParams) ([]BigmapKey, error) {
 	keys := make([]BigmapKey, 0)
 	u := params.AppendQuery(fmt.Sprintf("/explorer/bigmap/%d/keys", id))
@@ -0,0 +1,675 @@
+// Copyright (c) 2020-2023 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package tzstats
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+
+	"blockwatch.cc/tzgo/micheline"
+	"blockwatch.cc/tzgo/tezos"
+)
+
+// DefaultReorgDepth is the number of recent blocks a BigmapMirror can
+// roll back without a full re-bootstrap.
+const DefaultReorgDepth = 64
+
+// BigmapEntry is a single key/value pair of a mirrored bigmap.
+type BigmapEntry struct {
+	Hash   tezos.ExprHash `json:"hash"`
+	Key    micheline.Prim `json:"key"`
+	Value  micheline.Prim `json:"value"`
+	Height int64          `json:"height"`
+}
+
+func (e BigmapEntry) DecodeKey(typ micheline.Type) (micheline.Key, error) {
+	return micheline.NewKey(typ, e.Key)
+}
+
+func (e BigmapEntry) DecodeValue(typ micheline.Type) micheline.Value {
+	return micheline.NewValue(typ, e.Value)
+}
+
+// BigmapStore is a key-value store holding the state of a mirrored bigmap.
+// Changes become durable on Commit which also stores the sync position.
+type BigmapStore interface {
+	Get(hash tezos.ExprHash) (*BigmapEntry, bool, error)
+	Put(e *BigmapEntry) error
+	Delete(hash tezos.ExprHash) error
+	Clear() error
+	Len() int
+	ForEach(fn func(e *BigmapEntry) error) error
+	Position() (cursor uint64, height int64)
+	Commit(cursor uint64, height int64) error
+	Close() error
+}
+
+// MemoryBigmapStore is a volatile BigmapStore.
+type MemoryBigmapStore struct {
+	sync.RWMutex
+	entries map[string]*BigmapEntry
+	cursor  uint64
+	height  int64
+}
+
+func NewMemoryBigmapStore() *MemoryBigmapStore {
+	return &MemoryBigmapStore{
+		entries: make(map[string]*BigmapEntry),
+	}
+}
+
+func (s *MemoryBigmapStore) Get(hash tezos.ExprHash) (*BigmapEntry, bool, error) {
+	s.RLock()
+	defer s.RUnlock()
+	e, ok := s.entries[hash.String()]
+	return e, ok, nil
+}
+
+func (s *MemoryBigmapStore) Put(e *BigmapEntry) error {
+	s.Lock()
+	defer s.Unlock()
+	s.entries[e.Hash.String()] = e
+	return nil
+}
+
+func (s *MemoryBigmapStore) Delete(hash tezos.ExprHash) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.entries, hash.String())
+	return nil
+}
+
+func (s *MemoryBigmapStore) Clear() error {
+	s.Lock()
+	defer s.Unlock()
+	s.entries = make(map[string]*BigmapEntry)
+	return nil
+}
+
+func (s *MemoryBigmapStore) Len() int {
+	s.RLock()
+	defer s.RUnlock()
+	return len(s.entries)
+}
+
+// ForEach calls fn for all entries in key hash order.
+func (s *MemoryBigmapStore) ForEach(fn func(e *BigmapEntry) error) error {
+	s.RLock()
+	keys := make([]string, 0, len(s.entries))
+	for k := range s.entries {
+		keys = append(keys, k)
+	}
+	s.RUnlock()
+	sort.Strings(keys)
+	for _, k := range keys {
+		s.RLock()
+		e, ok := s.entries[k]
+		s.RUnlock()
+		if !ok {
+			continue
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemoryBigmapStore) Position() (uint64, int64) {
+	s.RLock()
+	defer s.RUnlock()
+	return s.cursor, s.height
+}
+
+func (s *MemoryBigmapStore) Commit(cursor uint64, height int64) error {
+	s.Lock()
+	defer s.Unlock()
+	s.cursor, s.height = cursor, height
+	return nil
+}
+
+func (s *MemoryBigmapStore) Close() error {
+	return nil
+}
+
+// FileBigmapStore keeps entries in memory and writes a JSON snapshot to
+// disk on each Commit. The file is replaced atomically.
+type FileBigmapStore struct {
+	*MemoryBigmapStore
+	path string
+}
+
+type fileBigmapState struct {
+	Cursor  uint64         `json:"cursor"`
+	Height  int64          `json:"height"`
+	Entries []*BigmapEntry `json:"entries"`
+}
+
+// NewFileBigmapStore opens the store at path and loads existing state.
+// A missing file yields an empty store.
+func NewFileBigmapStore(path string) (*FileBigmapStore, error) {
+	s := &FileBigmapStore{
+		MemoryBigmapStore: NewMemoryBigmapStore(),
+		path:              path,
+	}
+	buf, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		return s, nil
+	case err != nil:
+		return nil, err
+	}
+	var state fileBigmapState
+	if err := json.Unmarshal(buf, &state); err != nil {
+		return nil, fmt.Errorf("bigmap store %s: %v", path, err)
+	}
+	for _, e := range state.Entries {
+		s.entries[e.Hash.String()] = e
+	}
+	s.cursor, s.height = state.Cursor, state.Height
+	return s, nil
+}
+
+func (s *FileBigmapStore) Commit(cursor uint64, height int64) error {
+	if err := s.MemoryBigmapStore.Commit(cursor, height); err != nil {
+		return err
+	}
+	state := fileBigmapState{
+		Cursor:  cursor,
+		Height:  height,
+		Entries: make([]*BigmapEntry, 0, s.Len()),
+	}
+	_ = s.ForEach(func(e *BigmapEntry) error {
+		state.Entries = append(state.Entries, e)
+		return nil
+	})
+	buf, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// bigmapUndo records the state of a key before a change at height.
+type bigmapUndo struct {
+	height int64
+	hash   tezos.ExprHash
+	prev   *BigmapEntry
+}
+
+// BigmapMirror is a local replica of a single bigmap. It bootstraps from
+// the bigmap_values table and follows the bigmap_updates table. Recent
+// changes are journaled in memory together with the hashes of blocks they
+// came from so reorgs can be rolled back by height.
+type BigmapMirror struct {
+	BigmapId   int64
+	ReorgDepth int64
+
+	client  *Client
+	store   BigmapStore
+	journal []bigmapUndo
+	blocks  map[int64]tezos.BlockHash // hashes of blocks with journaled changes
+	base    int64                     // journal covers all changes above base
+	cursor  uint64
+	height  int64
+}
+
+// NewBigmapMirror creates a mirror for bigmap id backed by store. State
+// and sync position are restored from the store.
+func (c *Client) NewBigmapMirror(id int64, store BigmapStore) *BigmapMirror {
+	if store == nil {
+		store = NewMemoryBigmapStore()
+	}
+	m := &BigmapMirror{
+		BigmapId:   id,
+		ReorgDepth: DefaultReorgDepth,
+		client:     c,
+		store:      store,
+		blocks:     make(map[int64]tezos.BlockHash),
+	}
+	m.cursor, m.height = store.Position()
+	m.base = m.height
+	return m
+}
+
+func (m *BigmapMirror) Store() BigmapStore {
+	return m.store
+}
+
+// Height returns the height of the last applied update.
+func (m *BigmapMirror) Height() int64 {
+	return m.height
+}
+
+func (m *BigmapMirror) Cursor() uint64 {
+	return m.cursor
+}
+
+func (m *BigmapMirror) Get(hash tezos.ExprHash) (*BigmapEntry, bool, error) {
+	return m.store.Get(hash)
+}
+
+// Bootstrap replaces local state with the current bigmap content and
+// positions the update cursor at the current end of the updates table.
+func (m *BigmapMirror) Bootstrap(ctx context.Context) error {
+	// position first so updates written during bootstrap are replayed
+	cursor, err := m.lastUpdate(ctx)
+	if err != nil {
+		return err
+	}
+	if err := m.store.Clear(); err != nil {
+		return err
+	}
+	q := m.client.NewBigmapValueQuery()
+	q.WithFilter(FilterModeEqual, "bigmap_id", m.BigmapId)
+	var height int64
+	for {
+		list, err := q.Run(ctx)
+		if err != nil {
+			return err
+		}
+		for _, v := range list.Rows {
+			e, err := newBigmapEntry(v.Hash, v.Key, v.Value, v.Height)
+			if err != nil {
+				return err
+			}
+			if err := m.store.Put(e); err != nil {
+				return err
+			}
+			if v.Height > height {
+				height = v.Height
+			}
+		}
+		if list.Len() < q.Limit {
+			break
+		}
+		q.WithCursor(list.Cursor())
+	}
+	if cursor.Height > height {
+		height = cursor.Height
+	}
+	m.journal = nil
+	m.blocks = make(map[int64]tezos.BlockHash)
+	m.cursor, m.height, m.base = cursor.RowId, height, height
+	return m.store.Commit(m.cursor, m.height)
+}
+
+func (m *BigmapMirror) lastUpdate(ctx context.Context) (BigmapUpdateRow, error) {
+	q := m.client.NewBigmapUpdateQuery()
+	q.Columns = []string{"row_id", "height"}
+	q.WithFilter(FilterModeEqual, "bigmap_id", m.BigmapId)
+	q.WithOrder(OrderDesc)
+	q.WithLimit(1)
+	list, err := q.Run(ctx)
+	if err != nil || list.Len() == 0 {
+		return BigmapUpdateRow{}, err
+	}
+	return *list.Rows[0], nil
+}
+
+// Sync applies all updates since the last sync and returns the number of
+// applied updates. Journaled blocks that were replaced on the main chain
+// and updates below the last applied height signal a reorg and roll back
+// local state first.
+func (m *BigmapMirror) Sync(ctx context.Context) (int, error) {
+	if err := m.checkReorg(ctx); err != nil {
+		return 0, err
+	}
+	q := m.client.NewBigmapUpdateQuery()
+	q.WithFilter(FilterModeEqual, "bigmap_id", m.BigmapId)
+	if m.cursor > 0 {
+		q.WithCursor(m.cursor)
+	}
+	var n int
+	for {
+		list, err := q.Run(ctx)
+		if err != nil {
+			return n, err
+		}
+		heights := make([]int64, 0)
+		for _, r := range list.Rows {
+			if r.Height < m.height {
+				if err := m.Rollback(ctx, r.Height-1); err != nil {
+					return n, err
+				}
+				// rollback beyond the journal has bootstrapped a fresh state
+				if m.cursor >= r.RowId {
+					return n, nil
+				}
+			}
+			if err := m.Apply(ctx, r.Height, r.Event()); err != nil {
+				return n, err
+			}
+			if _, ok := m.blocks[r.Height]; !ok {
+				m.blocks[r.Height] = tezos.BlockHash{}
+				heights = append(heights, r.Height)
+			}
+			m.cursor = r.RowId
+			n++
+		}
+		if err := m.loadBlockHashes(ctx, heights); err != nil {
+			return n, err
+		}
+		if err := m.store.Commit(m.cursor, m.height); err != nil {
+			return n, err
+		}
+		if list.Len() < q.Limit {
+			break
+		}
+		q.WithCursor(list.Cursor())
+	}
+	return n, nil
+}
+
+// Apply applies bigmap events at height to local state. Events for other
+// bigmaps and copies from the mirrored bigmap are ignored. Changes are
+// committed on the next Sync or Commit.
+func (m *BigmapMirror) Apply(ctx context.Context, height int64, events ...micheline.BigmapEvent) error {
+	for _, ev := range events {
+		if ev.Action == micheline.DiffActionCopy {
+			if ev.DestId != m.BigmapId {
+				continue
+			}
+		} else if ev.Id != m.BigmapId {
+			continue
+		}
+		var err error
+		switch ev.Action {
+		case micheline.DiffActionAlloc:
+			err = m.reset(height)
+		case micheline.DiffActionCopy:
+			err = m.copy(ctx, ev.SourceId, height)
+		case micheline.DiffActionUpdate:
+			err = m.put(height, ev)
+		case micheline.DiffActionRemove:
+			if !ev.Key.IsValid() && !ev.KeyHash.IsValid() {
+				// removal of the entire bigmap
+				err = m.reset(height)
+			} else {
+				err = m.remove(height, ev)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if height > m.height {
+			m.height = height
+		}
+	}
+	m.trim()
+	return nil
+}
+
+// Commit persists local state and sync position.
+func (m *BigmapMirror) Commit() error {
+	return m.store.Commit(m.cursor, m.height)
+}
+
+// Rollback reverts all changes above height. When the journal does not
+// reach back far enough the mirror is bootstrapped again.
+func (m *BigmapMirror) Rollback(ctx context.Context, height int64) error {
+	if height >= m.height {
+		return nil
+	}
+	if height < m.base {
+		return m.Bootstrap(ctx)
+	}
+	for len(m.journal) > 0 {
+		u := m.journal[len(m.journal)-1]
+		if u.height <= height {
+			break
+		}
+		var err error
+		if u.prev != nil {
+			err = m.store.Put(u.prev)
+		} else {
+			err = m.store.Delete(u.hash)
+		}
+		if err != nil {
+			return err
+		}
+		m.journal = m.journal[:len(m.journal)-1]
+	}
+	for h := range m.blocks {
+		if h > height {
+			delete(m.blocks, h)
+		}
+	}
+	m.height = height
+	return nil
+}
+
+// checkReorg compares the hashes of journaled blocks with the main chain
+// and rolls back to the highest block that is unchanged.
+func (m *BigmapMirror) checkReorg(ctx context.Context) error {
+	if len(m.blocks) == 0 {
+		return nil
+	}
+	heights := make([]int64, 0, len(m.blocks))
+	for h := range m.blocks {
+		heights = append(heights, h)
+	}
+	sort.Slice(heights, func(i, j int) bool { return heights[i] > heights[j] })
+	hashes, err := m.client.blockHashes(ctx, heights)
+	if err != nil {
+		return err
+	}
+	valid := m.base
+	for _, h := range heights {
+		if hash, ok := hashes[h]; ok && hash.Equal(m.blocks[h]) {
+			valid = h
+			break
+		}
+	}
+	if valid == heights[0] {
+		return nil
+	}
+	return m.Rollback(ctx, valid)
+}
+
+// loadBlockHashes records the main chain hashes of blocks at heights.
+func (m *BigmapMirror) loadBlockHashes(ctx context.Context, heights []int64) error {
+	if len(heights) == 0 {
+		return nil
+	}
+	hashes, err := m.client.blockHashes(ctx, heights)
+	if err != nil {
+		return err
+	}
+	for _, h := range heights {
+		if h > m.base {
+			m.blocks[h] = hashes[h]
+		}
+	}
+	return nil
+}
+
+func (m *BigmapMirror) put(height int64, ev micheline.BigmapEvent) error {
+	hash := eventKeyHash(ev)
+	if err := m.record(height, hash); err != nil {
+		return err
+	}
+	return m.store.Put(&BigmapEntry{
+		Hash:   hash,
+		Key:    ev.Key,
+		Value:  ev.Value,
+		Height: height,
+	})
+}
+
+func (m *BigmapMirror) remove(height int64, ev micheline.BigmapEvent) error {
+	hash := eventKeyHash(ev)
+	if err := m.record(height, hash); err != nil {
+		return err
+	}
+	return m.store.Delete(hash)
+}
+
+func (m *BigmapMirror) reset(height int64) error {
+	hashes := make([]tezos.ExprHash, 0, m.store.Len())
+	_ = m.store.ForEach(func(e *BigmapEntry) error {
+		hashes = append(hashes, e.Hash)
+		return nil
+	})
+	for _, h := range hashes {
+		if err := m.record(height, h); err != nil {
+			return err
+		}
+		if err := m.store.Delete(h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copy replaces local state with the content of bigmap src at height.
+func (m *BigmapMirror) copy(ctx context.Context, src, height int64) error {
+	if err := m.reset(height); err != nil {
+		return err
+	}
+	params := NewContractParams().
+		WithBlock(strconv.FormatInt(height, 10)).
+		WithPrim().
+		WithLimit(DefaultPageSize)
+	var offset uint
+	for {
+		vals, err := m.client.ListBigmapValues(ctx, src, params.WithOffset(offset))
+		if err != nil {
+			return err
+		}
+		for _, v := range vals {
+			e := &BigmapEntry{
+				Hash:   v.Hash,
+				Height: height,
+			}
+			if v.KeyPrim != nil {
+				e.Key = *v.KeyPrim
+			}
+			if v.ValuePrim != nil {
+				e.Value = *v.ValuePrim
+			}
+			if err := m.record(height, e.Hash); err != nil {
+				return err
+			}
+			if err := m.store.Put(e); err != nil {
+				return err
+			}
+		}
+		if uint(len(vals)) < DefaultPageSize {
+			break
+		}
+		offset += uint(len(vals))
+	}
+	return nil
+}
+
+// record journals the current state of a key before it changes.
+func (m *BigmapMirror) record(height int64, hash tezos.ExprHash) error {
+	prev, _, err := m.store.Get(hash)
+	if err != nil {
+		return err
+	}
+	m.journal = append(m.journal, bigmapUndo{
+		height: height,
+		hash:   hash,
+		prev:   prev,
+	})
+	return nil
+}
+
+// trim drops journal entries older than ReorgDepth blocks.
+func (m *BigmapMirror) trim() {
+	limit := m.height - m.ReorgDepth
+	if limit <= m.base {
+		return
+	}
+	var i int
+	for i < len(m.journal) && m.journal[i].height <= limit {
+		i++
+	}
+	m.base = limit
+	for h := range m.blocks {
+		if h <= limit {
+			delete(m.blocks, h)
+		}
+	}
+	if i > 0 {
+		m.journal = append(m.journal[:0], m.journal[i:]...)
+	}
+}
+
+// blockHashes returns main chain block hashes by height.
+func (c *Client) blockHashes(ctx context.Context, heights []int64) (map[int64]tezos.BlockHash, error) {
+	res := make(map[int64]tezos.BlockHash, len(heights))
+	for len(heights) > 0 {
+		n := len(heights)
+		if n > DefaultPageSize {
+			n = DefaultPageSize
+		}
+		q := c.NewBlockQuery()
+		q.WithColumns("height", "hash")
+		q.WithFilter(FilterModeIn, "height", heights[:n])
+		blocks, err := q.Run(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range blocks.Rows {
+			res[b.Height] = b.Hash
+		}
+		heights = heights[n:]
+	}
+	return res, nil
+}
+
+func eventKeyHash(ev micheline.BigmapEvent) tezos.ExprHash {
+	if ev.KeyHash.IsValid() {
+		return ev.KeyHash
+	}
+	buf, _ := ev.Key.MarshalBinary()
+	return micheline.KeyHash(buf)
+}
+
+func newBigmapEntry(hash tezos.ExprHash, key, value string, height int64) (*BigmapEntry, error) {
+	e := &BigmapEntry{
+		Hash:   hash,
+		Height: height,
+	}
+	if err := unmarshalHexPrim(&e.Key, key); err != nil {
+		return nil, fmt.Errorf("bigmap key %s: %v", hash, err)
+	}
+	if err := unmarshalHexPrim(&e.Value, value); err != nil {
+		return nil, fmt.Errorf("bigmap value %s: %v", hash, err)
+	}
+	return e, nil
+}
+
+func unmarshalHexPrim(p *micheline.Prim, s string) error {
+	if len(s) == 0 {
+		return nil
+	}
+	buf, err := hex.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return p.UnmarshalBinary(buf)
+}
@@ -45,6 +45,7 @@ func (u BigmapUpdate) Event() (ev micheline.BigmapEvent) {
 			ev.ValueType = *u.ValueTypePrim
 		}
 	case micheline.DiffActionUpdate:
+		ev.KeyHash = u.Hash
 		if u.KeyPrim != nil {
 			ev.Key = *u.KeyPrim
 		}
@@ -52,6 +53,7 @@ func (u BigmapUpdate) Event() (ev micheline.BigmapEvent) {
 			ev.Value = *u.ValuePrim
 		}
 	case micheline.DiffActionRemove:
+		ev.KeyHash = u.Hash
 		if u.KeyPrim != nil {
 			ev.Key = *u.KeyPrim
 		}
@@ -95,6 +97,7 @@ func (r BigmapUpdateRow) Event() (ev micheline.BigmapEvent) {
 			_ = ev.ValueType.UnmarshalBinary(buf)
 		}
 	case micheline.DiffActionUpdate:
+		ev.KeyHash = r.Hash
 		if buf, err := hex.DecodeString(r.Key); err == nil {
 			_ = ev.Key.UnmarshalBinary(buf)
 		}
@@ -102,6 +105,7 @@ func (r BigmapUpdateRow) Event() (ev micheline.BigmapEvent) {
 			_ = ev.Value.UnmarshalBinary(buf)
 		}
 	case micheline.DiffActionRemove:
+		ev.KeyHash = r.Hash
 		if buf, err := hex.DecodeString(r.Key); err == nil {
 			_ = ev.Key.UnmarshalBinary(buf)
 		}
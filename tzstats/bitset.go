@@ -0,0 +1,190 @@
+// Copyright (c) 2020-2023 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package tzstats
+
+import (
+	"math/bits"
+)
+
+// Bitset is a bit vector in the layout used by rights bitmaps, position i
+// is stored in byte i/8 at bit i%8 (least significant bit first).
+type Bitset []byte
+
+func NewBitset(size int) Bitset {
+	return make(Bitset, (size+7)>>3)
+}
+
+// Len returns the capacity of the bitset in bits.
+func (b Bitset) Len() int {
+	return len(b) * 8
+}
+
+func (b Bitset) IsSet(i int) bool {
+	if i < 0 || i >= len(b)*8 {
+		return false
+	}
+	return (b[i>>3] & byte(1<<uint(i&0x7))) > 0
+}
+
+// Set sets bit i and grows the bitset when required.
+func (b *Bitset) Set(i int) {
+	if i < 0 {
+		return
+	}
+	if n := i>>3 + 1; n > len(*b) {
+		*b = append(*b, make([]byte, n-len(*b))...)
+	}
+	(*b)[i>>3] |= byte(1 << uint(i&0x7))
+}
+
+func (b Bitset) Clear(i int) {
+	if i < 0 || i >= len(b)*8 {
+		return
+	}
+	b[i>>3] &^= byte(1 << uint(i&0x7))
+}
+
+// Count returns the number of set bits.
+func (b Bitset) Count() int {
+	var n int
+	for _, v := range b {
+		n += bits.OnesCount8(v)
+	}
+	return n
+}
+
+func (b Bitset) IsZero() bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Positions returns all set positions in ascending order.
+func (b Bitset) Positions() []int {
+	list := make([]int, 0, b.Count())
+	b.ForEach(func(pos int) bool {
+		list = append(list, pos)
+		return true
+	})
+	return list
+}
+
+// ForEach calls fn for each set position in ascending order until fn
+// returns false.
+func (b Bitset) ForEach(fn func(pos int) bool) {
+	for i, v := range b {
+		for v != 0 {
+			k := bits.TrailingZeros8(v)
+			if !fn(i*8 + k) {
+				return
+			}
+			v &^= 1 << uint(k)
+		}
+	}
+}
+
+func (b Bitset) Clone() Bitset {
+	c := make(Bitset, len(b))
+	copy(c, b)
+	return c
+}
+
+// And returns positions set in both b and x.
+func (b Bitset) And(x Bitset) Bitset {
+	n := len(b)
+	if len(x) < n {
+		n = len(x)
+	}
+	res := make(Bitset, n)
+	for i := range res {
+		res[i] = b[i] & x[i]
+	}
+	return res
+}
+
+// AndNot returns positions set in b but not in x.
+func (b Bitset) AndNot(x Bitset) Bitset {
+	res := b.Clone()
+	for i := 0; i < len(res) && i < len(x); i++ {
+		res[i] &^= x[i]
+	}
+	return res
+}
+
+// Or returns positions set in either b or x.
+func (b Bitset) Or(x Bitset) Bitset {
+	if len(x) > len(b) {
+		b, x = x, b
+	}
+	res := b.Clone()
+	for i := range x {
+		res[i] |= x[i]
+	}
+	return res
+}
+
+// MergeBitsets returns the union of all sets, e.g. to combine the rights
+// of several bakers in one cycle.
+func MergeBitsets(sets ...Bitset) Bitset {
+	var res Bitset
+	for _, v := range sets {
+		res = res.Or(v)
+	}
+	return res
+}
+
+// Rights bitmaps as bitsets
+
+func (r CycleRights) BakeBits() Bitset {
+	return Bitset(r.Bake)
+}
+
+func (r CycleRights) EndorseBits() Bitset {
+	return Bitset(r.Endorse)
+}
+
+func (r CycleRights) BakedBits() Bitset {
+	return Bitset(r.Baked)
+}
+
+func (r CycleRights) EndorsedBits() Bitset {
+	return Bitset(r.Endorsed)
+}
+
+func (r CycleRights) SeedBits() Bitset {
+	return Bitset(r.Seed)
+}
+
+func (r CycleRights) SeededBits() Bitset {
+	return Bitset(r.Seeded)
+}
+
+// LostBakes returns positions of baking rights without a baked block.
+func (r CycleRights) LostBakes() Bitset {
+	return r.BakeBits().AndNot(r.BakedBits())
+}
+
+// StolenBakes returns positions of blocks baked without a first right.
+func (r CycleRights) StolenBakes() Bitset {
+	return r.BakedBits().AndNot(r.BakeBits())
+}
+
+// MissedEndorsements returns positions of endorsing rights not used.
+func (r CycleRights) MissedEndorsements() Bitset {
+	return r.EndorseBits().AndNot(r.EndorsedBits())
+}
+
+// MissedSeeds returns positions where a seed nonce was required but not
+// revealed.
+func (r CycleRights) MissedSeeds() Bitset {
+	return r.SeedBits().AndNot(r.SeededBits())
+}
+
+// HeightAt converts a bitmap position into a block height.
+func (r CycleRights) HeightAt(pos int) int64 {
+	return r.Height + int64(pos)
+}
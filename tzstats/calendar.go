@@ -0,0 +1,241 @@
+// Copyright (c) 2020-2023 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package tzstats
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"blockwatch.cc/tzgo/tezos"
+)
+
+// RightSlot is a single baking or endorsing right with an estimated time.
+// Times of past slots are estimated as well, use IsPast to distinguish.
+type RightSlot struct {
+	Type     tezos.RightType `json:"type"`
+	Height   int64           `json:"height"`
+	Cycle    int64           `json:"cycle"`
+	Time     time.Time       `json:"time"`
+	IsPast   bool            `json:"is_past"`
+	IsUsed   bool            `json:"is_used"`
+	IsLost   bool            `json:"is_lost"`
+	IsMissed bool            `json:"is_missed"`
+}
+
+// RightRange is a run of consecutive slots of the same type.
+type RightRange struct {
+	Type   tezos.RightType `json:"type"`
+	Start  int64           `json:"start_height"`
+	End    int64           `json:"end_height"`
+	From   time.Time       `json:"start_time"`
+	To     time.Time       `json:"end_time"`
+	NSlots int             `json:"n_slots"`
+}
+
+// RightsWindow is a period without any rights, e.g. for maintenance.
+type RightsWindow struct {
+	From     time.Time     `json:"start_time"`
+	To       time.Time     `json:"end_time"`
+	Duration time.Duration `json:"duration"`
+	Start    int64         `json:"start_height"` // first free block
+	End      int64         `json:"end_height"`   // last free block
+}
+
+type RightsCalendar struct {
+	Baker      tezos.Address `json:"baker"`
+	StartCycle int64         `json:"start_cycle"`
+	EndCycle   int64         `json:"end_cycle"`
+	Height     int64         `json:"height"` // chain tip when created
+	Time       time.Time     `json:"time"`
+	BlockDelay time.Duration `json:"block_delay"`
+	Slots      []RightSlot   `json:"slots"`
+}
+
+// GetRightsCalendar expands rights of a baker from startCycle to endCycle
+// (inclusive) into a sorted list of slots. Wall clock times are estimated
+// from the current tip assuming blocks are produced every minimal block
+// delay.
+func (c *Client) GetRightsCalendar(ctx context.Context, addr tezos.Address, startCycle, endCycle int64) (*RightsCalendar, error) {
+	if endCycle < startCycle {
+		return nil, fmt.Errorf("calendar: invalid cycle range %d..%d", startCycle, endCycle)
+	}
+	tip, err := c.GetTip(ctx)
+	if err != nil {
+		return nil, err
+	}
+	config, err := c.GetConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	delay := config.MinimalBlockDelay
+	if delay == 0 && config.TimeBetweenBlocks != nil {
+		delay = config.TimeBetweenBlocks[0]
+	}
+	cal := &RightsCalendar{
+		Baker:      addr,
+		StartCycle: startCycle,
+		EndCycle:   endCycle,
+		Height:     tip.Height,
+		Time:       tip.Timestamp,
+		BlockDelay: time.Duration(delay) * time.Second,
+		Slots:      make([]RightSlot, 0),
+	}
+	for cycle := startCycle; cycle <= endCycle; cycle++ {
+		r, err := c.ListBakerRights(ctx, addr, cycle, NewBakerParams())
+		if err != nil {
+			if ErrorStatus(err) == http.StatusNotFound {
+				continue
+			}
+			return nil, err
+		}
+		cal.addRights(r)
+	}
+	return cal, nil
+}
+
+func (cal *RightsCalendar) addRights(r *CycleRights) {
+	n := len(r.Bake) * 8
+	if l := len(r.Endorse) * 8; l > n {
+		n = l
+	}
+	for pos := 0; pos < n; pos++ {
+		height := r.Height + int64(pos)
+		for _, typ := range []tezos.RightType{tezos.RightTypeBaking, tezos.RightTypeEndorsing} {
+			right, ok := r.RightAt(height, typ)
+			if !ok || right.IsStolen {
+				continue
+			}
+			past := height <= cal.Height
+			cal.Slots = append(cal.Slots, RightSlot{
+				Type:     typ,
+				Height:   height,
+				Cycle:    r.Cycle,
+				Time:     cal.TimeAt(height),
+				IsPast:   past,
+				IsUsed:   right.IsUsed,
+				IsLost:   past && right.IsLost,
+				IsMissed: past && right.IsMissed,
+			})
+		}
+	}
+}
+
+// TimeAt estimates the time of block height.
+func (cal RightsCalendar) TimeAt(height int64) time.Time {
+	return cal.Time.Add(time.Duration(height-cal.Height) * cal.BlockDelay)
+}
+
+// Upcoming returns future slots.
+func (cal RightsCalendar) Upcoming() []RightSlot {
+	list := make([]RightSlot, 0)
+	for _, v := range cal.Slots {
+		if !v.IsPast {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// Ranges merges consecutive slots of the same type.
+func (cal RightsCalendar) Ranges() []RightRange {
+	list := make([]RightRange, 0)
+	open := make(map[tezos.RightType]int)
+	for _, v := range cal.Slots {
+		if i, ok := open[v.Type]; ok && list[i].End+1 == v.Height {
+			list[i].End = v.Height
+			list[i].To = v.Time.Add(cal.BlockDelay)
+			list[i].NSlots++
+			continue
+		}
+		open[v.Type] = len(list)
+		list = append(list, RightRange{
+			Type:   v.Type,
+			Start:  v.Height,
+			End:    v.Height,
+			From:   v.Time,
+			To:     v.Time.Add(cal.BlockDelay),
+			NSlots: 1,
+		})
+	}
+	return list
+}
+
+// Windows returns future periods of at least minDuration without any
+// rights between the chain tip and the last slot in the calendar.
+func (cal RightsCalendar) Windows(minDuration time.Duration) []RightsWindow {
+	list := make([]RightsWindow, 0)
+	next := cal.Height + 1
+	add := func(end int64) {
+		if end < next {
+			return
+		}
+		w := RightsWindow{
+			Start: next,
+			End:   end,
+			From:  cal.TimeAt(next),
+			To:    cal.TimeAt(end + 1),
+		}
+		w.Duration = w.To.Sub(w.From)
+		if w.Duration >= minDuration {
+			list = append(list, w)
+		}
+	}
+	for _, v := range cal.Slots {
+		if v.IsPast {
+			continue
+		}
+		add(v.Height - 1)
+		next = v.Height + 1
+	}
+	return list
+}
+
+// WriteICal exports future rights as iCalendar events with one event per
+// range of consecutive slots.
+func (cal RightsCalendar) WriteICal(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	line := func(format string, args ...interface{}) {
+		fmt.Fprintf(bw, format, args...)
+		bw.WriteString("\r\n")
+	}
+	stamp := time.Now().UTC().Format(icalTime)
+	line("BEGIN:VCALENDAR")
+	line("VERSION:2.0")
+	line("PRODID:-//Blockwatch Data Inc//tzstats-go//EN")
+	line("CALSCALE:GREGORIAN")
+	line("X-WR-CALNAME:Tezos rights %s", cal.Baker)
+	for _, r := range cal.Ranges() {
+		if r.End <= cal.Height {
+			continue
+		}
+		var summary string
+		switch r.Type {
+		case tezos.RightTypeBaking:
+			summary = "Bake"
+		default:
+			summary = "Endorse"
+		}
+		if r.Start == r.End {
+			summary = fmt.Sprintf("%s block %d", summary, r.Start)
+		} else {
+			summary = fmt.Sprintf("%s blocks %d-%d", summary, r.Start, r.End)
+		}
+		line("BEGIN:VEVENT")
+		line("UID:%s-%d-%d@tzstats", cal.Baker, r.Type, r.Start)
+		line("DTSTAMP:%s", stamp)
+		line("DTSTART:%s", r.From.UTC().Format(icalTime))
+		line("DTEND:%s", r.To.UTC().Format(icalTime))
+		line("SUMMARY:%s", summary)
+		line("DESCRIPTION:Baker %s\\, %d %s right(s)\\, estimated times", cal.Baker, r.NSlots, r.Type)
+		line("END:VEVENT")
+	}
+	line("END:VCALENDAR")
+	return bw.Flush()
+}
+
+const icalTime = "20060102T150405Z"
@@ -28,6 +28,10 @@ var (
 	IpfsClient       *Client
 )
 
+// DefaultPageSize is the number of rows requested per page by helpers that
+// iterate over explorer lists and table queries.
+const DefaultPageSize = 500
+
 func init() {
 	DefaultClient, _ = NewClient("https://api.tzstats.com", nil)
 	IpfsClient, _ = NewClient("https://ipfs.tzstats.com", nil)
@@ -39,6 +43,7 @@ type Client struct {
 	log        log.Logger
 	base       Params
 	market     Params
+	node       Params
 	cache      *lru.TwoQueueCache
 	headers    http.Header
 	userAgent  string
@@ -114,6 +119,15 @@ func (c *Client) WithMarketUrl(url string) *Client {
 	return c
 }
 
+// WithNodeUrl sets a Tezos node RPC endpoint used to run views. The indexer
+// does not serve node RPCs, so views cannot run without it.
+func (c *Client) WithNodeUrl(url string) *Client {
+	if params, err := ParseParams(url); err == nil {
+		c.node = params
+	}
+	return c
+}
+
 func (c *Client) WithTLS(tc *tls.Config) *Client {
 	c.transport.Transport.(*http.Transport).TLSClientConfig = tc
 	return c
@@ -215,3 +215,53 @@ func (c *Client) GetConstant(ctx context.Context, addr tezos.ExprHash, params Co
 	}
 	return cc, nil
 }
+
+// maximum nesting of constants inside constant values
+const maxConstantDepth = 16
+
+// ResolveConstants loads the values of global constants. Values are
+// cached by expression hash in the client's script cache.
+func (c *Client) ResolveConstants(ctx context.Context, hashes []tezos.ExprHash) (micheline.ConstantDict, error) {
+	dict := make(micheline.ConstantDict)
+	for _, h := range hashes {
+		if dict.Has(h) {
+			continue
+		}
+		key := h.String()
+		if c.cache != nil {
+			if val, ok := c.cache.Get(key); ok {
+				dict.Add(h, val.(micheline.Prim))
+				continue
+			}
+		}
+		cc, err := c.GetConstant(ctx, h, NewConstantParams())
+		if err != nil {
+			return nil, fmt.Errorf("constant %s: %w", h, err)
+		}
+		dict.Add(h, cc.Value)
+		if c.cache != nil {
+			c.cache.Add(key, cc.Value)
+		}
+	}
+	return dict, nil
+}
+
+// ExpandConstants replaces all constant instructions in script with their
+// values including constants nested inside constant values.
+func (c *Client) ExpandConstants(ctx context.Context, script *micheline.Script) error {
+	for i := 0; i < maxConstantDepth; i++ {
+		hashes := script.Constants()
+		if len(hashes) == 0 {
+			return nil
+		}
+		dict, err := c.ResolveConstants(ctx, hashes)
+		if err != nil {
+			return err
+		}
+		script.ExpandConstants(dict)
+	}
+	if len(script.Constants()) > 0 {
+		return fmt.Errorf("constants nested deeper than %d levels", maxConstantDepth)
+	}
+	return nil
+}
@@ -457,6 +457,15 @@ func (c *Client) GetContractScript(ctx context.Context, addr tezos.Address, para
 	if err := c.get(ctx, u, nil, cc); err != nil {
 		return nil, err
 	}
+	// inline global constants and derive types from the expanded script
+	if cc.Script != nil && len(cc.Script.Constants()) > 0 {
+		if err := c.ExpandConstants(ctx, cc.Script); err != nil {
+			return nil, err
+		}
+		cc.StorageType = cc.Script.StorageType().Typedef("")
+		cc.Entrypoints, _ = cc.Script.Entrypoints(true)
+		cc.Views, _ = cc.Script.Views(true, false)
+	}
 	return cc, nil
 }
 
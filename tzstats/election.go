@@ -0,0 +1,240 @@
+// Copyright (c) 2020-2023 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package tzstats
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"blockwatch.cc/tzgo/tezos"
+)
+
+// Supermajority is the share of yay votes among yay and nay votes required
+// in exploration and promotion periods.
+const Supermajority = 0.8
+
+type ElectionEventType string
+
+const (
+	ElectionEventPeriodStart   ElectionEventType = "period_start"
+	ElectionEventQuorumReached ElectionEventType = "quorum_reached"
+	ElectionEventClosed        ElectionEventType = "closed"
+)
+
+type ElectionEvent struct {
+	Type   ElectionEventType `json:"type"`
+	Status *ElectionStatus   `json:"status"`
+}
+
+// ElectionStatus is the state of the current period of an election with
+// turnout, majority and a linear turnout projection to the period end.
+type ElectionStatus struct {
+	ElectionId       int                    `json:"election_id"`
+	Stage            int                    `json:"stage"`
+	Kind             tezos.VotingPeriodKind `json:"voting_period_kind"`
+	IsOpen           bool                   `json:"is_open"`
+	Height           int64                  `json:"height"`
+	StartHeight      int64                  `json:"start_height"`
+	EndHeight        int64                  `json:"end_height"`
+	StartTime        time.Time              `json:"start_time"`
+	EndTime          time.Time              `json:"end_time"`
+	Progress         float64                `json:"progress"`
+	EligibleRolls    int                    `json:"eligible_rolls"`
+	EligibleVoters   int                    `json:"eligible_voters"`
+	QuorumRolls      int                    `json:"quorum_rolls"`
+	TurnoutRolls     int                    `json:"turnout_rolls"`
+	TurnoutVoters    int                    `json:"turnout_voters"`
+	Turnout          float64                `json:"turnout"`
+	Quorum           float64                `json:"quorum"`
+	HasQuorum        bool                   `json:"has_quorum"`
+	MissingRolls     int                    `json:"missing_rolls"`
+	ProjectedTurnout float64                `json:"projected_turnout"`
+	ProjectedQuorum  bool                   `json:"projected_quorum"`
+	YayRolls         int                    `json:"yay_rolls"`
+	NayRolls         int                    `json:"nay_rolls"`
+	PassRolls        int                    `json:"pass_rolls"`
+	Majority         float64                `json:"majority"`
+	HasMajority      bool                   `json:"has_majority"`
+	Leader           *Proposal              `json:"leader,omitempty"`
+	NonVoters        []Voter                `json:"non_voters"`
+}
+
+// ElectionTracker follows an election and reports status changes.
+type ElectionTracker struct {
+	ElectionId int
+	Interval   time.Duration
+
+	client *Client
+	last   *ElectionStatus
+}
+
+func (c *Client) NewElectionTracker(id int) *ElectionTracker {
+	return &ElectionTracker{
+		ElectionId: id,
+		Interval:   time.Minute,
+		client:     c,
+	}
+}
+
+// Status loads the election, its current period and all voters.
+func (t *ElectionTracker) Status(ctx context.Context) (*ElectionStatus, error) {
+	e, err := t.client.GetElection(ctx, t.ElectionId)
+	if err != nil {
+		return nil, err
+	}
+	if e.NumPeriods == 0 {
+		return nil, fmt.Errorf("election %d: no periods", t.ElectionId)
+	}
+	stage := e.NumPeriods - 1
+	vote := e.Period(tezos.ToVotingPeriod(stage))
+	if vote == nil {
+		return nil, fmt.Errorf("election %d: missing period %d", t.ElectionId, stage)
+	}
+	tip, err := t.client.GetTip(ctx)
+	if err != nil {
+		return nil, err
+	}
+	voters, err := t.client.ListVoters(ctx, t.ElectionId, stage)
+	if err != nil {
+		return nil, err
+	}
+	return NewElectionStatus(e, vote, stage, tip.Height, voters), nil
+}
+
+// NewElectionStatus computes the status of a voting period at height.
+func NewElectionStatus(e *Election, v *Vote, stage int, height int64, voters []Voter) *ElectionStatus {
+	s := &ElectionStatus{
+		ElectionId:     e.Id,
+		Stage:          stage,
+		Kind:           v.VotingPeriodKind,
+		IsOpen:         v.IsOpen,
+		Height:         height,
+		StartHeight:    v.StartHeight,
+		EndHeight:      v.EndHeight,
+		StartTime:      v.StartTime,
+		EndTime:        v.EndTime,
+		EligibleRolls:  v.EligibleRolls,
+		EligibleVoters: v.EligibleVoters,
+		QuorumRolls:    v.QuorumRolls,
+		TurnoutRolls:   v.TurnoutRolls,
+		TurnoutVoters:  v.TurnoutVoters,
+		YayRolls:       v.YayRolls,
+		NayRolls:       v.NayRolls,
+		PassRolls:      v.PassRolls,
+		NonVoters:      make([]Voter, 0),
+	}
+	if n := v.EndHeight - v.StartHeight + 1; n > 0 {
+		s.Progress = float64(height-v.StartHeight+1) / float64(n)
+		if s.Progress > 1 || !v.IsOpen {
+			s.Progress = 1
+		}
+		if s.Progress < 0 {
+			s.Progress = 0
+		}
+	}
+
+	// the proposal period quorum applies to the leading proposal only
+	turnout := v.TurnoutRolls
+	if v.VotingPeriodKind == tezos.VotingPeriodProposal {
+		for _, p := range v.Proposals {
+			if s.Leader == nil || p.Rolls > s.Leader.Rolls {
+				s.Leader = p
+			}
+		}
+		turnout = 0
+		if s.Leader != nil {
+			turnout = int(s.Leader.Rolls)
+		}
+	}
+	if v.EligibleRolls > 0 {
+		s.Turnout = float64(turnout) / float64(v.EligibleRolls)
+		s.Quorum = float64(v.QuorumRolls) / float64(v.EligibleRolls)
+	}
+	s.HasQuorum = turnout >= v.QuorumRolls
+	if !s.HasQuorum {
+		s.MissingRolls = v.QuorumRolls - turnout
+	}
+	s.ProjectedTurnout = s.Turnout
+	if s.Progress > 0 && s.Progress < 1 {
+		s.ProjectedTurnout = s.Turnout / s.Progress
+		if s.ProjectedTurnout > 1 {
+			s.ProjectedTurnout = 1
+		}
+	}
+	s.ProjectedQuorum = s.ProjectedTurnout >= s.Quorum
+
+	switch v.VotingPeriodKind {
+	case tezos.VotingPeriodExploration, tezos.VotingPeriodPromotion:
+		if sum := v.YayRolls + v.NayRolls; sum > 0 {
+			s.Majority = float64(v.YayRolls) / float64(sum)
+		}
+		s.HasMajority = s.Majority >= Supermajority
+	}
+
+	for _, voter := range voters {
+		if !voter.HasVoted {
+			s.NonVoters = append(s.NonVoters, voter)
+		}
+	}
+	sort.SliceStable(s.NonVoters, func(i, j int) bool {
+		a, b := s.NonVoters[i], s.NonVoters[j]
+		if a.Rolls != b.Rolls {
+			return a.Rolls > b.Rolls
+		}
+		return a.Stake > b.Stake
+	})
+	return s
+}
+
+// Poll loads the current status and returns events for changes since
+// the previous poll. The first poll emits a period start event.
+func (t *ElectionTracker) Poll(ctx context.Context) ([]ElectionEvent, *ElectionStatus, error) {
+	s, err := t.Status(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	events := make([]ElectionEvent, 0)
+	last := t.last
+	if last == nil || last.Stage != s.Stage {
+		events = append(events, ElectionEvent{Type: ElectionEventPeriodStart, Status: s})
+	}
+	if s.HasQuorum && (last == nil || last.Stage != s.Stage || !last.HasQuorum) {
+		events = append(events, ElectionEvent{Type: ElectionEventQuorumReached, Status: s})
+	}
+	if !s.IsOpen && (last == nil || last.IsOpen) {
+		events = append(events, ElectionEvent{Type: ElectionEventClosed, Status: s})
+	}
+	t.last = s
+	return events, s, nil
+}
+
+// Run polls the election every Interval and sends events to ch until the
+// election is closed or ctx is canceled. The channel is not closed.
+func (t *ElectionTracker) Run(ctx context.Context, ch chan<- ElectionEvent) error {
+	ticker := time.NewTicker(t.Interval)
+	defer ticker.Stop()
+	for {
+		events, s, err := t.Poll(ctx)
+		if err != nil {
+			return err
+		}
+		for _, e := range events {
+			select {
+			case ch <- e:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if !s.IsOpen {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
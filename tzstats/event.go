@@ -32,6 +32,30 @@ type Event struct {
 	columns []string `json:"-"`
 }
 
+// MakeType returns the Michelson type of the event payload.
+func (e Event) MakeType() micheline.Type {
+	return micheline.NewType(e.Type)
+}
+
+// Value returns the payload as typed Michelson value.
+func (e Event) Value() micheline.Value {
+	return micheline.NewValue(e.MakeType(), e.Payload)
+}
+
+// Decode returns the payload as a tree of maps, slices and scalars
+// using the field names from the event type.
+func (e Event) Decode() (interface{}, error) {
+	v := e.Value()
+	return v.Map()
+}
+
+// Unmarshal decodes the payload into a Go struct using JSON tags that
+// match the event type's field names.
+func (e Event) Unmarshal(val interface{}) error {
+	v := e.Value()
+	return v.Unmarshal(val)
+}
+
 type EventList struct {
 	Rows    []*Event
 	columns []string
@@ -138,6 +162,54 @@ type EventQuery struct {
 	tableQuery
 }
 
+// WithContract restricts the query to events emitted by addr.
+func (q EventQuery) WithContract(addr tezos.Address) EventQuery {
+	q.WithFilter(FilterModeEqual, "contract", addr)
+	return q
+}
+
+// WithTag restricts the query to events with any of the given tags.
+func (q EventQuery) WithTag(tags ...string) EventQuery {
+	if len(tags) == 1 {
+		q.WithFilter(FilterModeEqual, "tag", tags[0])
+	} else {
+		q.WithFilter(FilterModeIn, "tag", tags)
+	}
+	return q
+}
+
+// WithTypeHash restricts the query to events whose payload type has the
+// given hash.
+func (q EventQuery) WithTypeHash(hash string) EventQuery {
+	q.WithFilter(FilterModeEqual, "type_hash", hash)
+	return q
+}
+
+// ForEach runs the query across all result pages and calls fn with each
+// event and its decoded payload until fn returns an error. Pages end at
+// the first short or empty result, so a zero Limit uses the server default.
+func (q EventQuery) ForEach(ctx context.Context, fn func(e *Event, payload interface{}) error) error {
+	for {
+		list, err := q.Run(ctx)
+		if err != nil {
+			return err
+		}
+		for _, e := range list.Rows {
+			payload, err := e.Decode()
+			if err != nil {
+				return fmt.Errorf("event %d: %v", e.RowId, err)
+			}
+			if err := fn(e, payload); err != nil {
+				return err
+			}
+		}
+		if list.Len() == 0 || list.Len() < q.Limit {
+			return nil
+		}
+		q.WithCursor(list.Cursor())
+	}
+}
+
 func (c *Client) NewEventQuery() EventQuery {
 	tinfo, err := GetTypeInfo(&Event{})
 	if err != nil {
@@ -0,0 +1,287 @@
+// Copyright (c) 2020-2023 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package tzstats
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"blockwatch.cc/tzgo/tezos"
+)
+
+// CursorStore persists the position of an EventSubscriber.
+type CursorStore interface {
+	LoadCursor() (uint64, error)
+	SaveCursor(uint64) error
+}
+
+// FileCursor stores a cursor as decimal number in a file.
+type FileCursor string
+
+func (f FileCursor) LoadCursor() (uint64, error) {
+	buf, err := os.ReadFile(string(f))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(buf)), 10, 64)
+}
+
+// SaveCursor atomically replaces the cursor file.
+func (f FileCursor) SaveCursor(c uint64) error {
+	tmp := string(f) + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.FormatUint(c, 10)), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Clean(string(f)))
+}
+
+// EventMessage is a decoded contract event with operation and block
+// context. Payload is a pointer to the type registered for the event tag
+// or a generic tree of maps and slices. When the payload cannot be decoded
+// Payload is nil and Err is set.
+type EventMessage struct {
+	Event    *Event          `json:"event"`
+	Payload  interface{}     `json:"payload"`
+	OpHash   tezos.OpHash    `json:"op"`
+	OpType   OpType          `json:"op_type"`
+	Sender   tezos.Address   `json:"sender"`
+	Block    tezos.BlockHash `json:"block"`
+	Height   int64           `json:"height"`
+	Time     time.Time       `json:"time"`
+	Contract tezos.Address   `json:"contract"`
+	Tag      string          `json:"tag"`
+	Err      error           `json:"-"`
+}
+
+// EventSubscriber polls the event table for new events emitted by a set
+// of contracts and delivers decoded messages in order. The cursor is
+// saved after each delivered batch so a restarted subscriber resumes
+// where it stopped.
+type EventSubscriber struct {
+	Contracts []tezos.Address
+	Tags      []string
+	Interval  time.Duration
+	BatchSize int
+
+	client *Client
+	store  CursorStore
+	types  map[string]reflect.Type
+	cursor uint64
+	loaded bool
+}
+
+// NewEventSubscriber creates a subscriber that persists its cursor in
+// store. A nil store keeps the cursor in memory only.
+func (c *Client) NewEventSubscriber(store CursorStore) *EventSubscriber {
+	return &EventSubscriber{
+		Interval:  time.Minute,
+		BatchSize: DefaultPageSize,
+		client:    c,
+		store:     store,
+		types:     make(map[string]reflect.Type),
+	}
+}
+
+func (s *EventSubscriber) WithContract(addrs ...tezos.Address) *EventSubscriber {
+	s.Contracts = append(s.Contracts, addrs...)
+	return s
+}
+
+func (s *EventSubscriber) WithTag(tags ...string) *EventSubscriber {
+	s.Tags = append(s.Tags, tags...)
+	return s
+}
+
+func (s *EventSubscriber) WithInterval(d time.Duration) *EventSubscriber {
+	s.Interval = d
+	return s
+}
+
+// Register decodes payloads of events with tag into new values of the
+// type of proto, e.g. Register("transfer", TransferEvent{}).
+func (s *EventSubscriber) Register(tag string, proto interface{}) *EventSubscriber {
+	typ := reflect.TypeOf(proto)
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	s.types[tag] = typ
+	return s
+}
+
+// Cursor returns the row id of the last delivered event.
+func (s *EventSubscriber) Cursor() uint64 {
+	return s.cursor
+}
+
+// Reset moves the cursor, e.g. to 0 to replay all events.
+func (s *EventSubscriber) Reset(cursor uint64) error {
+	s.cursor = cursor
+	s.loaded = true
+	if s.store != nil {
+		return s.store.SaveCursor(cursor)
+	}
+	return nil
+}
+
+// Poll loads and decodes the next batch of events after the cursor. The
+// cursor is not advanced, call Commit after processing. Payload decoding
+// errors are reported per message in EventMessage.Err so a single bad
+// event does not block the subscriber.
+func (s *EventSubscriber) Poll(ctx context.Context) ([]EventMessage, error) {
+	if !s.loaded && s.store != nil {
+		c, err := s.store.LoadCursor()
+		if err != nil {
+			return nil, err
+		}
+		s.cursor = c
+	}
+	s.loaded = true
+
+	q := s.client.NewEventQuery()
+	q.WithLimit(s.BatchSize)
+	switch len(s.Contracts) {
+	case 0:
+	case 1:
+		q = q.WithContract(s.Contracts[0])
+	default:
+		q.WithFilter(FilterModeIn, "contract", s.Contracts)
+	}
+	if len(s.Tags) > 0 {
+		q = q.WithTag(s.Tags...)
+	}
+	if s.cursor > 0 {
+		q.WithCursor(s.cursor)
+	}
+	list, err := q.Run(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if list.Len() == 0 {
+		return nil, nil
+	}
+	ops, err := s.loadOps(ctx, list.Rows)
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]EventMessage, 0, list.Len())
+	for _, e := range list.Rows {
+		m := EventMessage{
+			Event:    e,
+			Height:   e.Height,
+			Contract: e.Contract,
+			Tag:      e.Tag,
+		}
+		if op, ok := ops[e.OpId]; ok {
+			m.OpHash = op.Hash
+			m.OpType = op.Type
+			m.Sender = op.Sender
+			m.Block = op.Block
+			m.Time = op.Timestamp
+		}
+		if typ, ok := s.types[e.Tag]; ok {
+			val := reflect.New(typ)
+			if err := e.Unmarshal(val.Interface()); err != nil {
+				m.Err = fmt.Errorf("event %d tag %q: %v", e.RowId, e.Tag, err)
+			} else {
+				m.Payload = val.Interface()
+			}
+		} else {
+			if m.Payload, err = e.Decode(); err != nil {
+				m.Payload = nil
+				m.Err = fmt.Errorf("event %d tag %q: %v", e.RowId, e.Tag, err)
+			}
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, nil
+}
+
+// Commit advances and persists the cursor past msg.
+func (s *EventSubscriber) Commit(msg EventMessage) error {
+	s.cursor = msg.Event.RowId
+	if s.store != nil {
+		return s.store.SaveCursor(s.cursor)
+	}
+	return nil
+}
+
+// Run polls for events every Interval and calls fn for each message in
+// order until ctx is canceled or fn fails. Messages that failed to decode
+// are delivered with Err set, fn may skip them. The cursor is saved after
+// each batch so messages are delivered at least once.
+func (s *EventSubscriber) Run(ctx context.Context, fn func(EventMessage) error) error {
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for {
+		msgs, err := s.Poll(ctx)
+		if err != nil {
+			return err
+		}
+		for i, m := range msgs {
+			if err := fn(m); err != nil {
+				if i > 0 {
+					_ = s.Commit(msgs[i-1])
+				}
+				return err
+			}
+		}
+		if len(msgs) > 0 {
+			if err := s.Commit(msgs[len(msgs)-1]); err != nil {
+				return err
+			}
+			// continue immediately while catching up
+			if len(msgs) >= s.BatchSize {
+				continue
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// loadOps loads operation context for events by op row id.
+func (s *EventSubscriber) loadOps(ctx context.Context, events []*Event) (map[uint64]*Op, error) {
+	ids := make([]uint64, 0, len(events))
+	seen := make(map[uint64]struct{})
+	for _, e := range events {
+		if _, ok := seen[e.OpId]; ok || e.OpId == 0 {
+			continue
+		}
+		seen[e.OpId] = struct{}{}
+		ids = append(ids, e.OpId)
+	}
+	ops := make(map[uint64]*Op, len(ids))
+	if len(ids) == 0 {
+		return ops, nil
+	}
+	q := s.client.NewOpQuery()
+	q.Columns = []string{"id", "type", "hash", "height", "time", "block", "sender"}
+	q.WithFilter(FilterModeIn, "id", ids)
+	for {
+		list, err := q.Run(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, op := range list.Rows {
+			ops[op.Id] = op
+		}
+		if list.Len() < q.Limit {
+			break
+		}
+		q.WithCursor(list.Cursor())
+	}
+	return ops, nil
+}
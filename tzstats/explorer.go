@@ -254,4 +254,6 @@ type Supply struct {
 	FrozenRewards       float64   `json:"frozen_rewards"`
 	FrozenFees          float64   `json:"frozen_fees"`
 	FrozenBonds         float64   `json:"frozen_bonds"`
+
+	columns []string `json:"-"`
 }
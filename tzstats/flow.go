@@ -0,0 +1,221 @@
+// Copyright (c) 2020-2023 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package tzstats
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"blockwatch.cc/tzgo/tezos"
+)
+
+type FlowKind string
+
+const (
+	FlowKindRewards    FlowKind = "rewards"
+	FlowKindDeposits   FlowKind = "deposits"
+	FlowKindFees       FlowKind = "fees"
+	FlowKindBalance    FlowKind = "balance"
+	FlowKindDelegation FlowKind = "delegation"
+	FlowKindBond       FlowKind = "bond"
+)
+
+type Flow struct {
+	RowId          uint64        `json:"row_id"`
+	Height         int64         `json:"height"`
+	Cycle          int64         `json:"cycle"`
+	Timestamp      time.Time     `json:"time"`
+	OpN            int           `json:"op_n"`
+	OpC            int           `json:"op_c"`
+	OpI            int           `json:"op_i"`
+	AccountId      uint64        `json:"account_id"`
+	Address        tezos.Address `json:"address"`
+	CounterPartyId uint64        `json:"counterparty_id"`
+	CounterParty   tezos.Address `json:"counterparty"`
+	Kind           FlowKind      `json:"kind"`
+	Type           OpType        `json:"type"`
+	AmountIn       float64       `json:"amount_in"`
+	AmountOut      float64       `json:"amount_out"`
+	IsFee          bool          `json:"is_fee"`
+	IsBurned       bool          `json:"is_burned"`
+	IsFrozen       bool          `json:"is_frozen"`
+	IsUnfrozen     bool          `json:"is_unfrozen"`
+	IsShielded     bool          `json:"is_shielded"`
+	IsUnshielded   bool          `json:"is_unshielded"`
+	TokenAge       int64         `json:"token_age"`
+	columns        []string      `json:"-"`
+}
+
+type FlowList struct {
+	Rows    []*Flow
+	columns []string
+}
+
+func (l FlowList) Len() int {
+	return len(l.Rows)
+}
+
+func (l FlowList) Cursor() uint64 {
+	if len(l.Rows) == 0 {
+		return 0
+	}
+	return l.Rows[len(l.Rows)-1].RowId
+}
+
+func (l *FlowList) UnmarshalJSON(data []byte) error {
+	if len(data) == 0 || bytes.Equal(data, null) {
+		return nil
+	}
+	if data[0] != '[' {
+		return fmt.Errorf("FlowList: expected JSON array")
+	}
+	array := make([]json.RawMessage, 0)
+	if err := json.Unmarshal(data, &array); err != nil {
+		return err
+	}
+	for _, v := range array {
+		r := &Flow{
+			columns: l.columns,
+		}
+		if err := r.UnmarshalJSON(v); err != nil {
+			return err
+		}
+		r.columns = nil
+		l.Rows = append(l.Rows, r)
+	}
+	return nil
+}
+
+func (f *Flow) UnmarshalJSON(data []byte) error {
+	if len(data) == 0 || bytes.Equal(data, null) {
+		return nil
+	}
+	if len(data) == 2 {
+		return nil
+	}
+	if data[0] == '[' {
+		return f.UnmarshalJSONBrief(data)
+	}
+	type Alias *Flow
+	return json.Unmarshal(data, Alias(f))
+}
+
+func (r *Flow) UnmarshalJSONBrief(data []byte) error {
+	flow := Flow{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	unpacked := make([]interface{}, 0)
+	err := dec.Decode(&unpacked)
+	if err != nil {
+		return err
+	}
+	for i, v := range r.columns {
+		f := unpacked[i]
+		if f == nil {
+			continue
+		}
+		switch v {
+		case "row_id":
+			flow.RowId, err = strconv.ParseUint(f.(json.Number).String(), 10, 64)
+		case "height":
+			flow.Height, err = strconv.ParseInt(f.(json.Number).String(), 10, 64)
+		case "cycle":
+			flow.Cycle, err = strconv.ParseInt(f.(json.Number).String(), 10, 64)
+		case "time":
+			var ts int64
+			ts, err = strconv.ParseInt(f.(json.Number).String(), 10, 64)
+			if err == nil {
+				flow.Timestamp = time.Unix(0, ts*1000000).UTC()
+			}
+		case "op_n":
+			flow.OpN, err = strconv.Atoi(f.(json.Number).String())
+		case "op_c":
+			flow.OpC, err = strconv.Atoi(f.(json.Number).String())
+		case "op_i":
+			flow.OpI, err = strconv.Atoi(f.(json.Number).String())
+		case "account_id":
+			flow.AccountId, err = strconv.ParseUint(f.(json.Number).String(), 10, 64)
+		case "address":
+			flow.Address, err = tezos.ParseAddress(f.(string))
+		case "counterparty_id":
+			flow.CounterPartyId, err = strconv.ParseUint(f.(json.Number).String(), 10, 64)
+		case "counterparty":
+			flow.CounterParty, err = tezos.ParseAddress(f.(string))
+		case "kind":
+			flow.Kind = FlowKind(f.(string))
+		case "type":
+			flow.Type = ParseOpType(f.(string))
+		case "amount_in":
+			flow.AmountIn, err = f.(json.Number).Float64()
+		case "amount_out":
+			flow.AmountOut, err = f.(json.Number).Float64()
+		case "is_fee":
+			flow.IsFee, err = strconv.ParseBool(f.(json.Number).String())
+		case "is_burned":
+			flow.IsBurned, err = strconv.ParseBool(f.(json.Number).String())
+		case "is_frozen":
+			flow.IsFrozen, err = strconv.ParseBool(f.(json.Number).String())
+		case "is_unfrozen":
+			flow.IsUnfrozen, err = strconv.ParseBool(f.(json.Number).String())
+		case "is_shielded":
+			flow.IsShielded, err = strconv.ParseBool(f.(json.Number).String())
+		case "is_unshielded":
+			flow.IsUnshielded, err = strconv.ParseBool(f.(json.Number).String())
+		case "token_age":
+			flow.TokenAge, err = strconv.ParseInt(f.(json.Number).String(), 10, 64)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	*r = flow
+	return nil
+}
+
+type FlowQuery struct {
+	tableQuery
+}
+
+func (c *Client) NewFlowQuery() FlowQuery {
+	tinfo, err := GetTypeInfo(&Flow{})
+	if err != nil {
+		panic(err)
+	}
+	q := tableQuery{
+		client:  c,
+		Params:  c.base.Copy(),
+		Table:   "flow",
+		Format:  FormatJSON,
+		Limit:   DefaultLimit,
+		Order:   OrderAsc,
+		Columns: tinfo.Aliases(),
+		Filter:  make(FilterList, 0),
+	}
+	return FlowQuery{q}
+}
+
+func (q FlowQuery) Run(ctx context.Context) (*FlowList, error) {
+	result := &FlowList{
+		columns: q.Columns,
+	}
+	if err := q.client.QueryTable(ctx, &q.tableQuery, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (c *Client) QueryFlows(ctx context.Context, filter FilterList, cols []string) (*FlowList, error) {
+	q := c.NewFlowQuery()
+	if len(cols) > 0 {
+		q.Columns = cols
+	}
+	if len(filter) > 0 {
+		q.Filter = filter
+	}
+	return q.Run(ctx)
+}
@@ -137,7 +137,7 @@ func hasPath(val interface{}, path string) bool {
 			}
 		case []interface{}:
 			idx, err := strconv.Atoi(v)
-			if err != nil || len(t) < idx {
+			if err != nil || idx < 0 || idx >= len(t) {
 				return false
 			}
 			next = t[idx]
@@ -165,7 +165,7 @@ func getPathString(val interface{}, path string) (string, bool) {
 			}
 		case []interface{}:
 			idx, err := strconv.Atoi(v)
-			if err != nil || len(t) < idx {
+			if err != nil || idx < 0 || idx >= len(t) {
 				return "", false
 			}
 			next = t[idx]
@@ -257,12 +257,3 @@ func min(x, y int) int {
 	}
 	return y
 }
-
-func nonNil(vals ...interface{}) interface{} {
-	for _, v := range vals {
-		if v != nil {
-			return v
-		}
-	}
-	return nil
-}
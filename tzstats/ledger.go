@@ -0,0 +1,288 @@
+// Copyright (c) 2020-2023 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package tzstats
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"blockwatch.cc/tzgo/tezos"
+)
+
+type LedgerCategory string
+
+const (
+	LedgerCategoryTransfer        LedgerCategory = "transfer"
+	LedgerCategoryFee             LedgerCategory = "fee"
+	LedgerCategoryBurn            LedgerCategory = "burn"
+	LedgerCategoryReward          LedgerCategory = "reward"
+	LedgerCategoryDelegation      LedgerCategory = "delegation"
+	LedgerCategoryOriginationBurn LedgerCategory = "origination_burn"
+)
+
+// Pseudo accounts used as the counter side of movements that do not
+// have an on-chain receiver or sender.
+const (
+	LedgerAccountFees    = "fees"
+	LedgerAccountBurn    = "burn"
+	LedgerAccountRewards = "rewards"
+	LedgerAccountNetwork = "network"
+)
+
+// LedgerEntry is one side of a double-entry booking. Both sides of a
+// booking share the same Id, the debit side carries a positive Debit
+// and the credit side an equal Credit amount.
+type LedgerEntry struct {
+	Id           int             `json:"id"`
+	Time         time.Time       `json:"time"`
+	Height       int64           `json:"height"`
+	Block        tezos.BlockHash `json:"block"`
+	OpHash       tezos.OpHash    `json:"op_hash"`
+	OpId         uint64          `json:"op_id"`
+	OpType       OpType          `json:"op_type"`
+	Category     LedgerCategory  `json:"category"`
+	Account      string          `json:"account"`
+	CounterParty string          `json:"counterparty"`
+	Debit        float64         `json:"debit"`
+	Credit       float64         `json:"credit"`
+}
+
+type LedgerEntryList []LedgerEntry
+
+var ledgerCsvHeader = []string{
+	"id",
+	"time",
+	"height",
+	"block",
+	"op_hash",
+	"op_id",
+	"op_type",
+	"category",
+	"account",
+	"counterparty",
+	"debit",
+	"credit",
+}
+
+// IsBalanced reports whether debits and credits sum up to the same amount.
+func (l LedgerEntryList) IsBalanced() bool {
+	var sum int64
+	for _, v := range l {
+		sum += toMutez(v.Debit) - toMutez(v.Credit)
+	}
+	return sum == 0
+}
+
+func (l LedgerEntryList) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(l)
+}
+
+func (l LedgerEntryList) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(ledgerCsvHeader); err != nil {
+		return err
+	}
+	for _, v := range l {
+		err := cw.Write([]string{
+			strconv.Itoa(v.Id),
+			v.Time.Format(time.RFC3339),
+			strconv.FormatInt(v.Height, 10),
+			v.Block.String(),
+			v.OpHash.String(),
+			strconv.FormatUint(v.OpId, 10),
+			v.OpType.String(),
+			string(v.Category),
+			v.Account,
+			v.CounterParty,
+			strconv.FormatFloat(v.Debit, 'f', 6, 64),
+			strconv.FormatFloat(v.Credit, 'f', 6, 64),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// ExportLedger returns balanced double-entry bookings for all Tez movements
+// of addrs between from and to (inclusive). Batches and internal operations
+// are expanded, fees and burns are taken from Op.Costs(). Movements between
+// two exported addresses are booked only once. A zero from or to time
+// leaves the range open.
+func (c *Client) ExportLedger(ctx context.Context, addrs []tezos.Address, from, to time.Time) (LedgerEntryList, error) {
+	own := tezos.NewAddressSet(addrs...)
+	seen := make(map[uint64]struct{})
+	ledger := &ledgerBuilder{
+		own:     own,
+		entries: make(LedgerEntryList, 0),
+	}
+	start := NewOpParams().WithOrder(OrderAsc).WithLimit(DefaultPageSize)
+	if !from.IsZero() {
+		height, err := c.firstHeightAfter(ctx, from)
+		if err != nil {
+			return nil, err
+		}
+		// since is exclusive
+		start = start.WithSince(strconv.FormatInt(height-1, 10))
+	}
+	for _, addr := range addrs {
+		params := start
+		for {
+			ops, err := c.GetAccountOps(ctx, addr, params)
+			if err != nil {
+				return nil, err
+			}
+			var done bool
+			for _, op := range ops {
+				if !from.IsZero() && op.Timestamp.Before(from) {
+					continue
+				}
+				if !to.IsZero() && op.Timestamp.After(to) {
+					done = true
+					break
+				}
+				// batch contents and internal operations share a hash, so
+				// dedup by row id
+				for _, o := range op.Content() {
+					if o.Id > 0 {
+						if _, ok := seen[o.Id]; ok {
+							continue
+						}
+						seen[o.Id] = struct{}{}
+					}
+					ledger.Add(o)
+				}
+			}
+			if done || len(ops) < int(DefaultPageSize) {
+				break
+			}
+			params = params.WithCursor(ops[len(ops)-1].Cursor())
+		}
+	}
+	sort.SliceStable(ledger.entries, func(i, j int) bool {
+		a, b := ledger.entries[i], ledger.entries[j]
+		if a.Height != b.Height {
+			return a.Height < b.Height
+		}
+		return a.Id < b.Id
+	})
+	return ledger.entries, nil
+}
+
+// firstHeightAfter returns the height of the first block at or after t.
+func (c *Client) firstHeightAfter(ctx context.Context, t time.Time) (int64, error) {
+	q := c.NewBlockQuery()
+	q.WithColumns("height", "time")
+	q.WithFilter(FilterModeGte, "time", t.Format(time.RFC3339))
+	q.WithLimit(1)
+	list, err := q.Run(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if list.Len() == 0 {
+		// from is in the future, nothing to export
+		tip, err := c.GetTip(ctx)
+		if err != nil {
+			return 0, err
+		}
+		return tip.Height + 1, nil
+	}
+	return list.Rows[0].Height, nil
+}
+
+type ledgerBuilder struct {
+	own     *tezos.AddressSet
+	entries LedgerEntryList
+	next    int
+}
+
+func (b *ledgerBuilder) Add(o *Op) {
+	costs := o.Costs()
+	payer := o.Sender
+	if o.IsInternal && o.Source.IsValid() {
+		payer = o.Source
+	}
+
+	switch o.Type {
+	case OpTypeBake, OpTypeBonus, OpTypeReward, OpTypeEndorsement,
+		OpTypeNonceRevelation, OpTypeVdfRevelation, OpTypeSubsidy,
+		OpTypeDoubleBaking, OpTypeDoubleEndorsement:
+		recv := o.Receiver
+		if !recv.IsValid() {
+			recv = o.Sender
+		}
+		b.book(o, LedgerCategoryReward, recv.String(), LedgerAccountRewards, o.Reward)
+		// fees collected by the block proposer
+		b.book(o, LedgerCategoryReward, recv.String(), LedgerAccountFees, o.Fee)
+		return
+	case OpTypeActivation, OpTypeAirdrop, OpTypeInvoice, OpTypeMigration:
+		recv := o.Receiver
+		if !recv.IsValid() {
+			recv = o.Sender
+		}
+		b.book(o, LedgerCategoryTransfer, recv.String(), LedgerAccountNetwork, o.Volume)
+		return
+	}
+
+	// fees are paid for failed operations too
+	b.book(o, LedgerCategoryFee, LedgerAccountFees, payer.String(), costs.Fee)
+	if !o.IsSuccess {
+		return
+	}
+
+	switch o.Type {
+	case OpTypeTransaction:
+		b.book(o, LedgerCategoryTransfer, o.Receiver.String(), o.Sender.String(), o.Volume)
+		b.book(o, LedgerCategoryBurn, LedgerAccountBurn, payer.String(), costs.Burn)
+	case OpTypeOrigination:
+		b.book(o, LedgerCategoryTransfer, o.Receiver.String(), o.Sender.String(), o.Volume)
+		b.book(o, LedgerCategoryOriginationBurn, LedgerAccountBurn, payer.String(), costs.Burn)
+	case OpTypeDelegation:
+		// delegation moves no funds, book a zero entry to keep a record
+		if b.isOwn(o.Sender.String()) {
+			b.emit(o, LedgerCategoryDelegation, o.Baker.String(), o.Sender.String(), 0)
+		}
+	default:
+		b.book(o, LedgerCategoryBurn, LedgerAccountBurn, payer.String(), costs.Burn)
+	}
+}
+
+func (b *ledgerBuilder) isOwn(s string) bool {
+	a, err := tezos.ParseAddress(s)
+	return err == nil && b.own.Contains(a)
+}
+
+// book adds a balanced pair of entries when at least one side is owned.
+func (b *ledgerBuilder) book(o *Op, cat LedgerCategory, debit, credit string, amount float64) {
+	if amount == 0 || !(b.isOwn(debit) || b.isOwn(credit)) {
+		return
+	}
+	b.emit(o, cat, debit, credit, amount)
+}
+
+func (b *ledgerBuilder) emit(o *Op, cat LedgerCategory, debit, credit string, amount float64) {
+	b.next++
+	e := LedgerEntry{
+		Id:       b.next,
+		Time:     o.Timestamp,
+		Height:   o.Height,
+		Block:    o.Block,
+		OpHash:   o.Hash,
+		OpId:     o.Id,
+		OpType:   o.Type,
+		Category: cat,
+	}
+	d, c := e, e
+	d.Account, d.CounterParty, d.Debit = debit, credit, amount
+	c.Account, c.CounterParty, c.Credit = credit, debit, amount
+	b.entries = append(b.entries, d, c)
+}
@@ -8,6 +8,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"math"
 	"sort"
 	"strconv"
 	"strings"
@@ -64,6 +65,7 @@ type Candle struct {
 	VolumeBuyQuote  float64   `json:"vol_buy_quote"`
 	VolumeSellBase  float64   `json:"vol_sell_base"`
 	VolumeSellQuote float64   `json:"vol_sell_quote"`
+	Null            bool      `json:"null,omitempty" tzstats:"noseries"` // gap without price data
 
 	columns []string
 }
@@ -256,3 +258,121 @@ func (c *Client) ListCandles(ctx context.Context, args CandleArgs) (*CandleList,
 	}
 	return resp, nil
 }
+
+// Resample aggregates candles into intervals of length d and fills empty
+// intervals according to mode. Candles must be sorted by time. Interval
+// start times are aligned to multiples of d since the zero time, so d should
+// be a divisor of one day or one of the Collapse constants. Empty candles
+// (with zero or null prices) in the input are ignored.
+func (l CandleList) Resample(d time.Duration, mode FillMode) CandleList {
+	res := CandleList{
+		Columns: l.Columns,
+		Rows:    make([]Candle, 0),
+	}
+	if d <= 0 || l.Len() == 0 {
+		return res
+	}
+
+	// aggregate non-empty candles into buckets
+	var cur *Candle
+	for _, c := range l.Rows {
+		if c.isEmpty() {
+			continue
+		}
+		ts := c.Timestamp.Truncate(d)
+		if cur == nil || !cur.Timestamp.Equal(ts) {
+			if cur != nil {
+				res.Rows = append(res.Rows, cur.finalize())
+			}
+			cur = &Candle{
+				Timestamp: ts,
+				Open:      c.Open,
+				High:      c.High,
+				Low:       c.Low,
+			}
+		}
+		cur.merge(c)
+	}
+	if cur != nil {
+		res.Rows = append(res.Rows, cur.finalize())
+	}
+	return res.Fill(d, mode)
+}
+
+// Fill inserts candles for missing intervals of length d between the first
+// and last candle. FillModeNone (and FillModeInvalid) leaves gaps in place,
+// FillModeNull inserts zero price candles with Null set, FillModeZero
+// inserts zero candles, FillModeLast repeats the previous close and
+// FillModeLinear interpolates between surrounding closes. Inserted candles
+// have no volume.
+func (l CandleList) Fill(d time.Duration, mode FillMode) CandleList {
+	switch mode {
+	case FillModeNull, FillModeLast, FillModeLinear, FillModeZero:
+	default:
+		return l
+	}
+	if d <= 0 || l.Len() < 2 {
+		return l
+	}
+	res := CandleList{
+		Columns: l.Columns,
+		Rows:    make([]Candle, 0, l.Len()),
+	}
+	for i, c := range l.Rows {
+		if i > 0 {
+			prev := l.Rows[i-1]
+			n := int(c.Timestamp.Sub(prev.Timestamp) / d)
+			for k := 1; k < n; k++ {
+				var price float64
+				switch mode {
+				case FillModeLast:
+					price = prev.Close
+				case FillModeLinear:
+					price = prev.Close + (c.Close-prev.Close)*float64(k)/float64(n)
+				}
+				res.Rows = append(res.Rows, Candle{
+					Timestamp: prev.Timestamp.Add(time.Duration(k) * d),
+					Open:      price,
+					High:      price,
+					Low:       price,
+					Close:     price,
+					Vwap:      price,
+					Null:      mode == FillModeNull,
+				})
+			}
+		}
+		res.Rows = append(res.Rows, c)
+	}
+	return res
+}
+
+func (c Candle) isEmpty() bool {
+	return c.Null || (c.Close == 0 && c.Open == 0)
+}
+
+// merge adds the trades and volume of x to an aggregate candle, vwap is
+// accumulated as quote volume and computed in finalize.
+func (c *Candle) merge(x Candle) {
+	c.High = math.Max(c.High, x.High)
+	c.Low = math.Min(c.Low, x.Low)
+	c.Close = x.Close
+	c.NTrades += x.NTrades
+	c.NBuy += x.NBuy
+	c.NSell += x.NSell
+	c.VolumeBase += x.VolumeBase
+	c.VolumeQuote += x.VolumeQuote
+	c.VolumeBuyBase += x.VolumeBuyBase
+	c.VolumeBuyQuote += x.VolumeBuyQuote
+	c.VolumeSellBase += x.VolumeSellBase
+	c.VolumeSellQuote += x.VolumeSellQuote
+	c.Vwap += x.Vwap * x.VolumeBase
+}
+
+func (c *Candle) finalize() Candle {
+	if c.VolumeBase > 0 {
+		c.Vwap /= c.VolumeBase
+	} else {
+		c.Vwap = c.Close
+	}
+	return *c
+}
@@ -0,0 +1,342 @@
+// Copyright (c) 2020-2023 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package tzstats
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultTickerTTL is the time after which a PriceOracle reloads tickers.
+const DefaultTickerTTL = time.Minute
+
+// PriceSource is a single exchange pair that contributed to a price.
+type PriceSource struct {
+	Exchange string    `json:"exchange"`
+	Pair     string    `json:"pair"`
+	Price    float64   `json:"price"`
+	Volume   float64   `json:"volume"` // base volume used as weight
+	Time     time.Time `json:"time"`
+	Inverted bool      `json:"inverted"`
+}
+
+// PriceQuote is the price of one unit of Base in Quote, derived from one or
+// more conversion steps along Path. Each step is a volume weighted average
+// over all exchanges listing the pair.
+type PriceQuote struct {
+	Base    string        `json:"base"`
+	Quote   string        `json:"quote"`
+	Price   float64       `json:"price"`
+	Time    time.Time     `json:"time"`
+	Path    []string      `json:"path"`
+	Sources []PriceSource `json:"sources"`
+}
+
+// PriceOracle answers price queries across exchanges and pairs. Pairs that
+// are not listed directly are synthesized from intermediate assets, e.g.
+// XTZ/EUR from XTZ/BTC and BTC/EUR.
+type PriceOracle struct {
+	Exchanges []string      // restrict sources to these exchanges, empty means all
+	Collapse  time.Duration // candle interval for historic prices
+	MaxHops   int           // max conversion steps
+	TickerTTL time.Duration // max age of loaded tickers
+
+	client   *Client
+	tickers  []Ticker
+	loadTime time.Time
+	candles  map[string]*candleWindow // one window per pair and interval
+}
+
+// candleWindow caches candles of a single pair for [from, to).
+type candleWindow struct {
+	from, to time.Time
+	loadTime time.Time
+	rows     []Candle
+}
+
+func (c *Client) NewPriceOracle() *PriceOracle {
+	return &PriceOracle{
+		Collapse:  Collapse1h,
+		MaxHops:   3,
+		TickerTTL: DefaultTickerTTL,
+		client:    c,
+		candles:   make(map[string]*candleWindow),
+	}
+}
+
+func (o *PriceOracle) WithExchanges(names ...string) *PriceOracle {
+	o.Exchanges = names
+	return o
+}
+
+func (o *PriceOracle) WithCollapse(d time.Duration) *PriceOracle {
+	o.Collapse = d
+	return o
+}
+
+// Load fetches the list of tickers which defines available pairs and
+// current prices. Tickers are reloaded automatically when older than
+// TickerTTL.
+func (o *PriceOracle) Load(ctx context.Context) error {
+	ticks, err := o.client.GetTickers(ctx)
+	if err != nil {
+		return err
+	}
+	o.tickers = make([]Ticker, 0, len(ticks))
+	for _, t := range ticks {
+		if o.useExchange(t.Exchange) {
+			o.tickers = append(o.tickers, t)
+		}
+	}
+	o.loadTime = time.Now()
+	return nil
+}
+
+// Price returns the current price of base in quote from tickers.
+func (o *PriceOracle) Price(ctx context.Context, base, quote string) (*PriceQuote, error) {
+	return o.quote(ctx, base, quote, func(_ context.Context, t Ticker) (PriceSource, bool, error) {
+		return PriceSource{
+			Exchange: t.Exchange,
+			Pair:     t.Pair,
+			Price:    t.Last,
+			Volume:   t.VolumeBase,
+			Time:     t.Time,
+		}, t.Last > 0, nil
+	})
+}
+
+// PriceAt returns the price of base in quote at time t from candles of
+// all contributing pairs. Each pair keeps one window of DefaultPageSize
+// candles around the last requested time, so lookups at nearby times do
+// not issue new requests. Windows reaching past their load time expire
+// after TickerTTL.
+func (o *PriceOracle) PriceAt(ctx context.Context, base, quote string, t time.Time) (*PriceQuote, error) {
+	q, err := o.quote(ctx, base, quote, func(ctx context.Context, tick Ticker) (PriceSource, bool, error) {
+		c, ok, err := o.candleAt(ctx, tick, t)
+		if err != nil || !ok {
+			return PriceSource{}, false, err
+		}
+		price := c.Vwap
+		if price == 0 {
+			price = c.Close
+		}
+		return PriceSource{
+			Exchange: tick.Exchange,
+			Pair:     tick.Pair,
+			Price:    price,
+			Volume:   c.VolumeBase,
+			Time:     c.Timestamp,
+		}, price > 0, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	q.Time = t
+	return q, nil
+}
+
+type priceFunc func(context.Context, Ticker) (PriceSource, bool, error)
+
+func (o *PriceOracle) quote(ctx context.Context, base, quote string, fn priceFunc) (*PriceQuote, error) {
+	if o.tickers == nil || (o.TickerTTL > 0 && time.Since(o.loadTime) > o.TickerTTL) {
+		if err := o.Load(ctx); err != nil {
+			return nil, err
+		}
+	}
+	base, quote = strings.ToUpper(base), strings.ToUpper(quote)
+	res := &PriceQuote{
+		Base:    base,
+		Quote:   quote,
+		Price:   1,
+		Path:    []string{base},
+		Sources: make([]PriceSource, 0),
+	}
+	if base == quote {
+		return res, nil
+	}
+
+	// try paths from shortest to longest until all steps can be priced
+	for _, path := range o.paths(base, quote) {
+		price := 1.0
+		sources := make([]PriceSource, 0)
+		var last time.Time
+		ok := true
+		for i := 1; i < len(path); i++ {
+			p, src, err := o.step(ctx, path[i-1], path[i], fn)
+			if err != nil {
+				return nil, err
+			}
+			if len(src) == 0 {
+				ok = false
+				break
+			}
+			price *= p
+			sources = append(sources, src...)
+			for _, s := range src {
+				if s.Time.After(last) {
+					last = s.Time
+				}
+			}
+		}
+		if ok {
+			res.Price = price
+			res.Path = path
+			res.Sources = sources
+			res.Time = last
+			return res, nil
+		}
+	}
+	return nil, fmt.Errorf("oracle: no price for %s/%s", base, quote)
+}
+
+// step returns the volume weighted price of one unit of from in to across
+// all listed pairs in either direction.
+func (o *PriceOracle) step(ctx context.Context, from, to string, fn priceFunc) (float64, []PriceSource, error) {
+	var (
+		sum, vol, plain float64
+		sources         []PriceSource
+	)
+	for _, t := range o.tickers {
+		var inverted bool
+		switch {
+		case strings.EqualFold(t.Base, from) && strings.EqualFold(t.Quote, to):
+		case strings.EqualFold(t.Base, to) && strings.EqualFold(t.Quote, from):
+			inverted = true
+		default:
+			continue
+		}
+		src, ok, err := fn(ctx, t)
+		if err != nil {
+			return 0, nil, err
+		}
+		if !ok {
+			continue
+		}
+		price, weight := src.Price, src.Volume
+		if inverted {
+			// weight is kept in units of the original base asset
+			weight *= src.Price
+			price = 1 / price
+			src.Inverted = true
+		}
+		sum += price * weight
+		vol += weight
+		plain += price
+		sources = append(sources, src)
+	}
+	if len(sources) == 0 {
+		return 0, nil, nil
+	}
+	if vol > 0 {
+		return sum / vol, sources, nil
+	}
+	return plain / float64(len(sources)), sources, nil
+}
+
+// paths lists conversion paths from base to quote up to MaxHops steps,
+// shortest first. Paths of equal length are ordered by asset name so the
+// selected path is stable.
+func (o *PriceOracle) paths(base, quote string) [][]string {
+	edges := make(map[string]map[string]bool)
+	link := func(a, b string) {
+		if edges[a] == nil {
+			edges[a] = make(map[string]bool)
+		}
+		edges[a][b] = true
+	}
+	for _, t := range o.tickers {
+		b, q := strings.ToUpper(t.Base), strings.ToUpper(t.Quote)
+		link(b, q)
+		link(q, b)
+	}
+	maxHops := o.MaxHops
+	if maxHops <= 0 {
+		maxHops = 1
+	}
+	res := make([][]string, 0)
+	queue := [][]string{{base}}
+	for len(queue) > 0 {
+		path := queue[0]
+		queue = queue[1:]
+		last := path[len(path)-1]
+		if last == quote {
+			res = append(res, path)
+			continue
+		}
+		if len(path) > maxHops {
+			continue
+		}
+		next := make([]string, 0, len(edges[last]))
+		for n := range edges[last] {
+			next = append(next, n)
+		}
+		sort.Strings(next)
+	expand:
+		for _, n := range next {
+			for _, v := range path {
+				if v == n {
+					continue expand
+				}
+			}
+			p := make([]string, len(path), len(path)+1)
+			copy(p, path)
+			queue = append(queue, append(p, n))
+		}
+	}
+	return res
+}
+
+func (o *PriceOracle) candleAt(ctx context.Context, tick Ticker, t time.Time) (Candle, bool, error) {
+	start := t.Truncate(o.Collapse)
+	key := tick.Exchange + "/" + tick.Pair + "/" + o.Collapse.String()
+	w, ok := o.candles[key]
+	if !ok || start.Before(w.from) || !start.Before(w.to) || o.isStale(w) {
+		from := start.Add(-DefaultPageSize / 2 * o.Collapse)
+		to := from.Add(DefaultPageSize * o.Collapse)
+		list, err := o.client.ListCandles(ctx, CandleArgs{
+			Market:   tick.Exchange,
+			Pair:     tick.Pair,
+			Collapse: o.Collapse,
+			From:     from,
+			To:       to,
+			Limit:    DefaultPageSize + 1,
+		})
+		if err != nil {
+			return Candle{}, false, err
+		}
+		w = &candleWindow{
+			from:     from,
+			to:       to,
+			loadTime: time.Now(),
+			rows:     list.Rows,
+		}
+		o.candles[key] = w
+	}
+	idx := sort.Search(len(w.rows), func(i int) bool { return !w.rows[i].Timestamp.Before(start) })
+	if idx < len(w.rows) && w.rows[idx].Timestamp.Equal(start) && !w.rows[idx].isEmpty() {
+		return w.rows[idx], true, nil
+	}
+	return Candle{}, false, nil
+}
+
+// isStale reports whether w may miss candles that were not yet closed
+// when it was loaded.
+func (o *PriceOracle) isStale(w *candleWindow) bool {
+	return o.TickerTTL > 0 && w.to.After(w.loadTime) && time.Since(w.loadTime) > o.TickerTTL
+}
+
+func (o *PriceOracle) useExchange(name string) bool {
+	if len(o.Exchanges) == 0 {
+		return true
+	}
+	for _, v := range o.Exchanges {
+		if strings.EqualFold(v, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,448 @@
+// Copyright (c) 2020-2023 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package tzstats
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"blockwatch.cc/tzgo/tezos"
+)
+
+// Path is a compiled query into decoded contract storage, bigmap values
+// and keys. The syntax is a subset of JSONPath:
+//
+//	a.b.c          child fields, numeric fields also index arrays
+//	a[0], a[-1]    array index, negative from end
+//	a['x.y']       quoted field name
+//	a.*, a[*]      all children of a map or array
+//	a..b           recursive descent, b at any depth below a
+//	a[?(@.x==3)]   children matching a predicate
+//
+// Predicates compare a relative path with a number, quoted string, true,
+// false or null using ==, !=, <, <=, > or >=. A predicate without operator
+// tests for existence, e.g. [?(@.x)]. A leading $ is optional.
+type Path struct {
+	src   string
+	steps []pathStep
+}
+
+type pathStepKind byte
+
+const (
+	pathStepField pathStepKind = iota
+	pathStepIndex
+	pathStepWildcard
+	pathStepFilter
+)
+
+type pathStep struct {
+	kind      pathStepKind
+	recursive bool
+	name      string
+	index     int
+	filter    *pathFilter
+}
+
+type pathFilter struct {
+	path  *Path
+	op    string
+	value interface{}
+}
+
+// PathMatch is a single result of a path query.
+type PathMatch struct {
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+func (m PathMatch) GetString() (string, bool) {
+	return getPathString(m.Value, "")
+}
+
+func (m PathMatch) GetInt64() (int64, bool) {
+	return getPathInt64(m.Value, "")
+}
+
+func (m PathMatch) GetBig() (*big.Int, bool) {
+	return getPathBig(m.Value, "")
+}
+
+func (m PathMatch) GetZ() (tezos.Z, bool) {
+	return getPathZ(m.Value, "")
+}
+
+func (m PathMatch) GetTime() (time.Time, bool) {
+	return getPathTime(m.Value, "")
+}
+
+func (m PathMatch) GetAddress() (tezos.Address, bool) {
+	return getPathAddress(m.Value, "")
+}
+
+func (m PathMatch) GetValue() interface{} {
+	return m.Value
+}
+
+func ParsePath(s string) (*Path, error) {
+	p := &Path{src: s}
+	if err := p.parse(); err != nil {
+		return nil, fmt.Errorf("path %q: %v", s, err)
+	}
+	return p, nil
+}
+
+func MustParsePath(s string) *Path {
+	p, err := ParsePath(s)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+func (p Path) String() string {
+	return p.src
+}
+
+func (p *Path) parse() error {
+	s := strings.TrimPrefix(strings.TrimSpace(p.src), "$")
+	for i := 0; i < len(s); {
+		var recursive bool
+		switch s[i] {
+		case '.':
+			i++
+			if i < len(s) && s[i] == '.' {
+				recursive = true
+				i++
+			}
+			// a..[0] or a.[0] falls through to the bracket step below
+		case '[':
+		default:
+			if i > 0 {
+				return fmt.Errorf("unexpected %q at %d", s[i], i)
+			}
+		}
+		if i < len(s) && s[i] == '[' {
+			end := matchBracket(s, i)
+			if end < 0 {
+				return fmt.Errorf("unterminated [ at %d", i)
+			}
+			step, err := parseBracket(s[i+1 : end])
+			if err != nil {
+				return err
+			}
+			step.recursive = recursive
+			p.steps = append(p.steps, step)
+			i = end + 1
+			continue
+		}
+		j := i
+		for j < len(s) && s[j] != '.' && s[j] != '[' {
+			j++
+		}
+		name := s[i:j]
+		if name == "" {
+			return fmt.Errorf("empty field at %d", i)
+		}
+		step := pathStep{kind: pathStepField, name: name, recursive: recursive}
+		if name == "*" {
+			step.kind = pathStepWildcard
+		}
+		p.steps = append(p.steps, step)
+		i = j
+	}
+	return nil
+}
+
+// matchBracket returns the position of the ] closing the [ at i.
+func matchBracket(s string, i int) int {
+	var depth int
+	var quote byte
+	for ; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '[' || c == '(':
+			depth++
+		case c == ']' || c == ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func parseBracket(s string) (pathStep, error) {
+	s = strings.TrimSpace(s)
+	switch {
+	case s == "*":
+		return pathStep{kind: pathStepWildcard}, nil
+	case strings.HasPrefix(s, "?(") && strings.HasSuffix(s, ")"):
+		f, err := parseFilter(s[2 : len(s)-1])
+		if err != nil {
+			return pathStep{}, err
+		}
+		return pathStep{kind: pathStepFilter, filter: f}, nil
+	case len(s) >= 2 && (s[0] == '\'' || s[0] == '"') && s[len(s)-1] == s[0]:
+		return pathStep{kind: pathStepField, name: s[1 : len(s)-1]}, nil
+	default:
+		idx, err := strconv.Atoi(s)
+		if err != nil {
+			return pathStep{}, fmt.Errorf("invalid selector [%s]", s)
+		}
+		return pathStep{kind: pathStepIndex, index: idx}, nil
+	}
+}
+
+var pathFilterOps = []string{"==", "!=", "<=", ">=", "<", ">"}
+
+func parseFilter(s string) (*pathFilter, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "@") {
+		return nil, fmt.Errorf("filter must start with @: %s", s)
+	}
+	f := &pathFilter{}
+	lhs := s
+	if i, op := indexFilterOp(s); i > 0 {
+		f.op = op
+		lhs = strings.TrimSpace(s[:i])
+		f.value = parseFilterValue(strings.TrimSpace(s[i+len(op):]))
+	}
+	p, err := ParsePath(strings.TrimPrefix(lhs, "@"))
+	if err != nil {
+		return nil, err
+	}
+	f.path = p
+	return f, nil
+}
+
+// indexFilterOp returns the position of the first comparison operator
+// outside of quoted strings.
+func indexFilterOp(s string) (int, string) {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+			continue
+		case c == '\'' || c == '"':
+			quote = c
+			continue
+		}
+		for _, op := range pathFilterOps {
+			if strings.HasPrefix(s[i:], op) {
+				return i, op
+			}
+		}
+	}
+	return -1, ""
+}
+
+func parseFilterValue(s string) interface{} {
+	switch {
+	case len(s) >= 2 && (s[0] == '\'' || s[0] == '"') && s[len(s)-1] == s[0]:
+		return s[1 : len(s)-1]
+	case s == "true":
+		return true
+	case s == "false":
+		return false
+	case s == "null":
+		return nil
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f
+	}
+	return s
+}
+
+// Select returns all matches of the path in val in document order. Map
+// children are visited in sorted key order.
+func (p Path) Select(val interface{}) []PathMatch {
+	res := []PathMatch{{Path: "", Value: val}}
+	for _, step := range p.steps {
+		next := make([]PathMatch, 0)
+		for _, m := range res {
+			if step.recursive {
+				for _, d := range descendants(m) {
+					next = append(next, step.apply(d)...)
+				}
+			} else {
+				next = append(next, step.apply(m)...)
+			}
+		}
+		res = next
+	}
+	return res
+}
+
+// First returns the first match of the path in val.
+func (p Path) First(val interface{}) (PathMatch, bool) {
+	res := p.Select(val)
+	if len(res) == 0 {
+		return PathMatch{}, false
+	}
+	return res[0], true
+}
+
+func (s pathStep) apply(m PathMatch) []PathMatch {
+	switch s.kind {
+	case pathStepField:
+		switch t := m.Value.(type) {
+		case map[string]interface{}:
+			if v, ok := t[s.name]; ok {
+				return []PathMatch{{joinPath(m.Path, s.name), v}}
+			}
+		case []interface{}:
+			if idx, err := strconv.Atoi(s.name); err == nil && idx >= 0 && idx < len(t) {
+				return []PathMatch{{joinPath(m.Path, s.name), t[idx]}}
+			}
+		}
+	case pathStepIndex:
+		if t, ok := m.Value.([]interface{}); ok {
+			idx := s.index
+			if idx < 0 {
+				idx += len(t)
+			}
+			if idx >= 0 && idx < len(t) {
+				return []PathMatch{{joinPath(m.Path, strconv.Itoa(idx)), t[idx]}}
+			}
+		}
+	case pathStepWildcard:
+		return children(m)
+	case pathStepFilter:
+		res := make([]PathMatch, 0)
+		for _, c := range children(m) {
+			if s.filter.match(c.Value) {
+				res = append(res, c)
+			}
+		}
+		return res
+	}
+	return nil
+}
+
+func (f pathFilter) match(val interface{}) bool {
+	m, ok := f.path.First(val)
+	if !ok {
+		return false
+	}
+	if f.op == "" {
+		return true
+	}
+	if f.value == nil {
+		return (m.Value == nil) == (f.op == "==")
+	}
+	var cmp int
+	switch v := f.value.(type) {
+	case float64:
+		x, err := strconv.ParseFloat(ToString(m.Value), 64)
+		if err != nil {
+			return f.op == "!="
+		}
+		switch {
+		case x < v:
+			cmp = -1
+		case x > v:
+			cmp = 1
+		}
+	case bool:
+		b, err := strconv.ParseBool(ToString(m.Value))
+		if err != nil || f.op != "==" && f.op != "!=" {
+			return f.op == "!="
+		}
+		if b != v {
+			cmp = 1
+		}
+	default:
+		cmp = strings.Compare(ToString(m.Value), ToString(v))
+	}
+	switch f.op {
+	case "==":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+func children(m PathMatch) []PathMatch {
+	switch t := m.Value.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		res := make([]PathMatch, len(keys))
+		for i, k := range keys {
+			res[i] = PathMatch{joinPath(m.Path, k), t[k]}
+		}
+		return res
+	case []interface{}:
+		res := make([]PathMatch, len(t))
+		for i, v := range t {
+			res[i] = PathMatch{joinPath(m.Path, strconv.Itoa(i)), v}
+		}
+		return res
+	}
+	return nil
+}
+
+// descendants returns m and all nodes below m in pre-order.
+func descendants(m PathMatch) []PathMatch {
+	res := []PathMatch{m}
+	for _, c := range children(m) {
+		res = append(res, descendants(c)...)
+	}
+	return res
+}
+
+func joinPath(base, name string) string {
+	if base == "" {
+		return name
+	}
+	return base + "." + name
+}
+
+func queryPath(val interface{}, path string) ([]PathMatch, error) {
+	p, err := ParsePath(path)
+	if err != nil {
+		return nil, err
+	}
+	return p.Select(val), nil
+}
+
+func (v ContractValue) Query(path string) ([]PathMatch, error) {
+	return queryPath(v.Value, path)
+}
+
+func (v BigmapValue) Query(path string) ([]PathMatch, error) {
+	return queryPath(v.Value, path)
+}
+
+func (k MultiKey) Query(path string) ([]PathMatch, error) {
+	return queryPath(k.value(), path)
+}
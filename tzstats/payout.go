@@ -0,0 +1,235 @@
+// Copyright (c) 2020-2023 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package tzstats
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/big"
+	"strconv"
+	"text/tabwriter"
+
+	"blockwatch.cc/tzgo/tezos"
+)
+
+// OverdelegationMode defines how rewards are shared when a baker's staking
+// balance exceeds the stake that is active for consensus.
+type OverdelegationMode string
+
+const (
+	// all stake shares rewards pro-rata, overdelegation dilutes everyone
+	OverdelegationProportional OverdelegationMode = "proportional"
+	// the baker's own balance is active first, delegators share the rest
+	OverdelegationBakerFirst OverdelegationMode = "baker_first"
+)
+
+type PayoutStatus string
+
+const (
+	PayoutStatusPay           PayoutStatus = "pay"
+	PayoutStatusBelowMinimum  PayoutStatus = "below_min_payout"
+	PayoutStatusMinDelegation PayoutStatus = "below_min_delegation"
+	PayoutStatusExcluded      PayoutStatus = "excluded"
+)
+
+// PayoutConfig contains payout rules. Fee is a fraction (0.1 = 10%),
+// MinPayout and MinDelegation are in tez.
+type PayoutConfig struct {
+	Fee            float64            `json:"fee"`
+	MinPayout      float64            `json:"min_payout"`
+	MinDelegation  float64            `json:"min_delegation"`
+	Overdelegation OverdelegationMode `json:"overdelegation"`
+	Exclude        []tezos.Address    `json:"exclude,omitempty"`
+}
+
+// Payout is the reward share of a single delegator in mutez.
+type Payout struct {
+	Address tezos.Address `json:"address"`
+	Balance int64         `json:"balance"`
+	Share   float64       `json:"share"`
+	Gross   int64         `json:"gross"`
+	Fee     int64         `json:"fee"`
+	Net     int64         `json:"net"`
+	Status  PayoutStatus  `json:"status"`
+}
+
+func (p Payout) IsPaid() bool {
+	return p.Status == PayoutStatusPay
+}
+
+// PayoutPlan lists delegator payouts for one baker and cycle. All amounts
+// are in mutez like CycleSnapshot.
+type PayoutPlan struct {
+	Baker          tezos.Address `json:"baker"`
+	Cycle          int64         `json:"cycle"`
+	SnapshotCycle  int64         `json:"snapshot_cycle"`
+	SnapshotHeight int64         `json:"snapshot_height"`
+	StakingBalance int64         `json:"staking_balance"`
+	ActiveStake    int64         `json:"active_stake"`
+	OwnBalance     int64         `json:"own_balance"`
+	TotalIncome    int64         `json:"total_income"`
+	TotalPaid      int64         `json:"total_paid"`
+	TotalFees      int64         `json:"total_fees"`
+	BakerIncome    int64         `json:"baker_income"` // income kept by the baker incl fees
+	Config         PayoutConfig  `json:"config"`
+	Payouts        []Payout      `json:"payouts"`
+}
+
+// GetPayoutConfig returns payout rules from a baker's public metadata.
+func (c *Client) GetPayoutConfig(ctx context.Context, addr tezos.Address) (PayoutConfig, error) {
+	cfg := PayoutConfig{
+		Overdelegation: OverdelegationProportional,
+	}
+	b, err := c.GetBaker(ctx, addr, NewBakerParams().WithMeta())
+	if err != nil {
+		return cfg, err
+	}
+	if b.Metadata != nil {
+		if m := b.Metadata.Baker(); m != nil {
+			cfg.Fee = m.Fee
+			cfg.MinPayout = m.MinPayout
+			cfg.MinDelegation = m.MinDelegation
+		}
+	}
+	return cfg, nil
+}
+
+// ComputePayouts distributes a baker's total income for cycle across
+// delegators based on their snapshot balances.
+func (c *Client) ComputePayouts(ctx context.Context, addr tezos.Address, cycle int64, cfg PayoutConfig) (*PayoutPlan, error) {
+	snap, err := c.GetBakerSnapshot(ctx, addr, cycle, NewBakerParams())
+	if err != nil {
+		return nil, err
+	}
+	return NewPayoutPlan(addr, snap, cfg)
+}
+
+// NewPayoutPlan computes payouts from a cycle snapshot. Shares are computed
+// with integer math and rounded down so the plan never pays out more than
+// the baker earned.
+func NewPayoutPlan(addr tezos.Address, snap *CycleSnapshot, cfg PayoutConfig) (*PayoutPlan, error) {
+	if cfg.Fee < 0 || cfg.Fee > 1 {
+		return nil, fmt.Errorf("payout: invalid fee %f", cfg.Fee)
+	}
+	if cfg.Overdelegation == "" {
+		cfg.Overdelegation = OverdelegationProportional
+	}
+	plan := &PayoutPlan{
+		Baker:          addr,
+		Cycle:          snap.BakeCycle,
+		SnapshotCycle:  snap.Cycle,
+		SnapshotHeight: snap.Height,
+		StakingBalance: snap.StakingBalance,
+		ActiveStake:    snap.ActiveStake,
+		OwnBalance:     snap.OwnBalance,
+		TotalIncome:    snap.TotalIncome,
+		Config:         cfg,
+		Payouts:        make([]Payout, 0, len(snap.Delegators)),
+	}
+
+	// delegators share income in proportion pool/base
+	var pool, base int64
+	switch {
+	case cfg.Overdelegation == OverdelegationBakerFirst &&
+		snap.ActiveStake > 0 && snap.ActiveStake < snap.StakingBalance:
+		own := snap.OwnBalance
+		if own > snap.ActiveStake {
+			own = snap.ActiveStake
+		}
+		pool = mulDiv(snap.TotalIncome, snap.ActiveStake-own, snap.ActiveStake)
+		base = snap.StakingBalance - snap.OwnBalance
+	default:
+		pool = snap.TotalIncome
+		base = snap.StakingBalance
+	}
+
+	exclude := tezos.NewAddressSet(cfg.Exclude...)
+	minDelegation := toMutez(cfg.MinDelegation)
+	minPayout := toMutez(cfg.MinPayout)
+
+	for _, d := range snap.Delegators {
+		if d.Address.Equal(addr) {
+			continue
+		}
+		p := Payout{
+			Address: d.Address,
+			Balance: d.Balance,
+			Status:  PayoutStatusPay,
+		}
+		if base > 0 {
+			p.Share = float64(d.Balance) / float64(base)
+			p.Gross = mulDiv(pool, d.Balance, base)
+		}
+		p.Fee = int64(float64(p.Gross) * cfg.Fee)
+		p.Net = p.Gross - p.Fee
+		switch {
+		case exclude.Contains(d.Address):
+			p.Status = PayoutStatusExcluded
+		case d.Balance < minDelegation:
+			p.Status = PayoutStatusMinDelegation
+		case p.Net <= 0 || p.Net < minPayout:
+			p.Status = PayoutStatusBelowMinimum
+		}
+		if p.IsPaid() {
+			plan.TotalPaid += p.Net
+			plan.TotalFees += p.Fee
+		}
+		plan.Payouts = append(plan.Payouts, p)
+	}
+	plan.BakerIncome = plan.TotalIncome - plan.TotalPaid
+	return plan, nil
+}
+
+// Paid returns payouts that should be sent.
+func (p PayoutPlan) Paid() []Payout {
+	list := make([]Payout, 0, len(p.Payouts))
+	for _, v := range p.Payouts {
+		if v.IsPaid() {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// WriteReport writes a human readable payout table.
+func (p PayoutPlan) WriteReport(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "Baker\t%s\t\n", p.Baker)
+	fmt.Fprintf(tw, "Cycle\t%d\t\n", p.Cycle)
+	fmt.Fprintf(tw, "Snapshot\t%d/%d\t\n", p.SnapshotCycle, p.SnapshotHeight)
+	fmt.Fprintf(tw, "Staking\t%s\t\n", formatMutez(p.StakingBalance))
+	fmt.Fprintf(tw, "Active\t%s\t\n", formatMutez(p.ActiveStake))
+	fmt.Fprintf(tw, "Income\t%s\t\n", formatMutez(p.TotalIncome))
+	fmt.Fprintf(tw, "Paid\t%s\t\n", formatMutez(p.TotalPaid))
+	fmt.Fprintf(tw, "Fees\t%s\t\n", formatMutez(p.TotalFees))
+	fmt.Fprintf(tw, "Kept\t%s\t\n", formatMutez(p.BakerIncome))
+	fmt.Fprintln(tw, "\t\t")
+	fmt.Fprintln(tw, "Address\tBalance\tShare\tGross\tFee\tNet\tStatus\t")
+	for _, v := range p.Payouts {
+		fmt.Fprintf(tw, "%s\t%s\t%.4f%%\t%s\t%s\t%s\t%s\t\n",
+			v.Address,
+			formatMutez(v.Balance),
+			v.Share*100,
+			formatMutez(v.Gross),
+			formatMutez(v.Fee),
+			formatMutez(v.Net),
+			v.Status,
+		)
+	}
+	return tw.Flush()
+}
+
+// mulDiv returns a*b/c without intermediate overflow.
+func mulDiv(a, b, c int64) int64 {
+	if c == 0 {
+		return 0
+	}
+	x := new(big.Int).Mul(big.NewInt(a), big.NewInt(b))
+	return x.Quo(x, big.NewInt(c)).Int64()
+}
+
+func formatMutez(v int64) string {
+	return strconv.FormatFloat(fromMutez(v), 'f', 6, 64)
+}
@@ -0,0 +1,367 @@
+// Copyright (c) 2020-2023 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package tzstats
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"blockwatch.cc/tzgo/tezos"
+)
+
+type PerformanceEventType string
+
+const (
+	PerformanceEventLostBake          PerformanceEventType = "lost_bake"
+	PerformanceEventStolenBake        PerformanceEventType = "stolen_bake"
+	PerformanceEventMissedEndorsement PerformanceEventType = "missed_endorsement"
+	PerformanceEventMissedSeed        PerformanceEventType = "missed_seed"
+)
+
+// PerformanceEvent is a single lost or gained right. Loss is an estimate
+// in tez. For lost bakes it is the baker's average block income in that
+// cycle, for missed endorsements and seeds the cycle's EndorsingLoss and
+// SeedLoss are split evenly across events.
+type PerformanceEvent struct {
+	Baker  tezos.Address        `json:"baker"`
+	Cycle  int64                `json:"cycle"`
+	Height int64                `json:"height"`
+	Time   time.Time            `json:"time"`
+	Type   PerformanceEventType `json:"type"`
+	Loss   float64              `json:"loss"`
+	Other  tezos.Address        `json:"other,omitempty"` // baker of a lost block
+}
+
+// CyclePerformance aggregates events for one baker and cycle.
+type CyclePerformance struct {
+	Baker               tezos.Address      `json:"baker"`
+	Cycle               int64              `json:"cycle"`
+	NBakingRights       int64              `json:"n_baking_rights"`
+	NEndorsingRights    int64              `json:"n_endorsing_rights"`
+	NLostBakes          int                `json:"n_lost_bakes"`
+	NStolenBakes        int                `json:"n_stolen_bakes"`
+	NMissedEndorsements int                `json:"n_missed_endorsements"`
+	NMissedSeeds        int                `json:"n_missed_seeds"`
+	PerformancePct      float64            `json:"performance_percent"`
+	ExpectedIncome      float64            `json:"expected_income"`
+	TotalIncome         float64            `json:"total_income"`
+	TotalLoss           float64            `json:"total_loss"`
+	EndorsingLoss       float64            `json:"endorsing_loss"`
+	SeedLoss            float64            `json:"seed_loss"`
+	Events              []PerformanceEvent `json:"events"`
+}
+
+func (p CyclePerformance) HasIssues() bool {
+	return p.NLostBakes+p.NMissedEndorsements+p.NMissedSeeds > 0
+}
+
+type PerformanceReport struct {
+	StartCycle int64              `json:"start_cycle"`
+	EndCycle   int64              `json:"end_cycle"`
+	Height     int64              `json:"height"`
+	Cycles     []CyclePerformance `json:"cycles"`
+}
+
+// GetPerformanceReport collects lost and stolen bakes, missed endorsements
+// and unrevealed seeds of bakers between startCycle and endCycle (inclusive).
+// Rights beyond the current chain tip are ignored.
+func (c *Client) GetPerformanceReport(ctx context.Context, bakers []tezos.Address, startCycle, endCycle int64) (*PerformanceReport, error) {
+	tip, err := c.GetTip(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if endCycle > tip.Cycle {
+		endCycle = tip.Cycle
+	}
+	rep := &PerformanceReport{
+		StartCycle: startCycle,
+		EndCycle:   endCycle,
+		Height:     tip.Height,
+		Cycles:     make([]CyclePerformance, 0),
+	}
+	if len(bakers) == 0 || endCycle < startCycle {
+		return rep, nil
+	}
+	addrs := make([]string, len(bakers))
+	for i, v := range bakers {
+		addrs[i] = v.String()
+	}
+
+	// load income per baker and cycle
+	income := make(map[string]*Income)
+	iq := c.NewIncomeQuery()
+	iq.WithFilter(FilterModeIn, "address", addrs)
+	iq.WithFilter(FilterModeRange, "cycle", startCycle, endCycle)
+	for {
+		list, err := iq.Run(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range list.Rows {
+			income[perfKey(v.Address, v.Cycle)] = v
+		}
+		if list.Len() < iq.Limit {
+			break
+		}
+		iq.WithCursor(list.Cursor())
+	}
+
+	// load rights and extract events
+	rq := c.NewCycleRightsQuery()
+	rq.WithFilter(FilterModeIn, "address", addrs)
+	rq.WithFilter(FilterModeRange, "cycle", startCycle, endCycle)
+	heights := make(map[int64]*Block)
+	for {
+		list, err := rq.Run(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range list.Rows {
+			p := newCyclePerformance(r, tip, income[perfKey(r.Address, r.Cycle)])
+			for _, e := range p.Events {
+				heights[e.Height] = nil
+			}
+			rep.Cycles = append(rep.Cycles, p)
+		}
+		if list.Len() < rq.Limit {
+			break
+		}
+		rq.WithCursor(list.Cursor())
+	}
+
+	// annotate events with block times and bakers
+	if err := c.loadPerformanceBlocks(ctx, heights); err != nil {
+		return nil, err
+	}
+	for i := range rep.Cycles {
+		for j := range rep.Cycles[i].Events {
+			e := &rep.Cycles[i].Events[j]
+			if b := heights[e.Height]; b != nil {
+				e.Time = b.Timestamp
+				if e.Type == PerformanceEventLostBake {
+					e.Other = b.Baker
+				}
+			}
+		}
+	}
+	sort.SliceStable(rep.Cycles, func(i, j int) bool {
+		a, b := rep.Cycles[i], rep.Cycles[j]
+		if a.Cycle != b.Cycle {
+			return a.Cycle < b.Cycle
+		}
+		return a.Baker.String() < b.Baker.String()
+	})
+	return rep, nil
+}
+
+func newCyclePerformance(r *CycleRights, tip *Tip, inc *Income) CyclePerformance {
+	p := CyclePerformance{
+		Baker:  r.Address,
+		Cycle:  r.Cycle,
+		Events: make([]PerformanceEvent, 0),
+	}
+	n := len(r.Bake) * 8
+	if l := len(r.Endorse) * 8; l > n {
+		n = l
+	}
+	for pos := 0; pos < n; pos++ {
+		height := r.Height + int64(pos)
+		if height > tip.Height {
+			break
+		}
+		ev := PerformanceEvent{
+			Baker:  r.Address,
+			Cycle:  r.Cycle,
+			Height: height,
+		}
+		if isSet(r.Bake, pos) {
+			p.NBakingRights++
+		}
+		if isSet(r.Endorse, pos) {
+			p.NEndorsingRights++
+		}
+		if r.IsLost(pos) {
+			ev.Type = PerformanceEventLostBake
+			p.Events = append(p.Events, ev)
+			p.NLostBakes++
+		}
+		if r.IsStolen(pos) {
+			ev.Type = PerformanceEventStolenBake
+			p.Events = append(p.Events, ev)
+			p.NStolenBakes++
+		}
+		if r.IsMissed(pos) {
+			ev.Type = PerformanceEventMissedEndorsement
+			p.Events = append(p.Events, ev)
+			p.NMissedEndorsements++
+		}
+		// seeds are revealed during the next cycle
+		if r.Cycle < tip.Cycle && r.IsSeedRequired(pos) && !r.IsSeedRevealed(pos) {
+			ev.Type = PerformanceEventMissedSeed
+			p.Events = append(p.Events, ev)
+			p.NMissedSeeds++
+		}
+	}
+	if inc == nil {
+		return p
+	}
+	p.PerformancePct = inc.PerformancePct
+	p.ExpectedIncome = inc.ExpectedIncome
+	p.TotalIncome = inc.TotalIncome
+	p.TotalLoss = inc.TotalLoss
+	p.EndorsingLoss = inc.EndorsingLoss
+	p.SeedLoss = inc.SeedLoss
+	var blockIncome float64
+	if inc.NBlocksBaked > 0 {
+		blockIncome = (inc.BakingIncome + inc.FeesIncome) / float64(inc.NBlocksBaked)
+	}
+	for i := range p.Events {
+		e := &p.Events[i]
+		switch e.Type {
+		case PerformanceEventLostBake:
+			e.Loss = blockIncome
+		case PerformanceEventMissedEndorsement:
+			e.Loss = p.EndorsingLoss / float64(p.NMissedEndorsements)
+		case PerformanceEventMissedSeed:
+			e.Loss = p.SeedLoss / float64(p.NMissedSeeds)
+		}
+	}
+	return p
+}
+
+func (c *Client) loadPerformanceBlocks(ctx context.Context, heights map[int64]*Block) error {
+	list := make([]int64, 0, len(heights))
+	for h := range heights {
+		list = append(list, h)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i] < list[j] })
+	for len(list) > 0 {
+		n := len(list)
+		if n > DefaultPageSize {
+			n = DefaultPageSize
+		}
+		q := c.NewBlockQuery()
+		q.WithColumns("height", "time", "baker")
+		q.WithFilter(FilterModeIn, "height", list[:n])
+		blocks, err := q.Run(ctx)
+		if err != nil {
+			return err
+		}
+		for _, b := range blocks.Rows {
+			heights[b.Height] = b
+		}
+		list = list[n:]
+	}
+	return nil
+}
+
+func perfKey(addr tezos.Address, cycle int64) string {
+	return fmt.Sprintf("%s/%d", addr, cycle)
+}
+
+// Events returns all events in the report.
+func (r PerformanceReport) Events() []PerformanceEvent {
+	list := make([]PerformanceEvent, 0)
+	for _, v := range r.Cycles {
+		list = append(list, v.Events...)
+	}
+	return list
+}
+
+// Bakers aggregates cycles per baker.
+func (r PerformanceReport) Bakers() []CyclePerformance {
+	list := make([]CyclePerformance, 0)
+	idx := make(map[string]int)
+	for _, v := range r.Cycles {
+		key := v.Baker.String()
+		i, ok := idx[key]
+		if !ok {
+			i = len(list)
+			idx[key] = i
+			list = append(list, CyclePerformance{
+				Baker:  v.Baker,
+				Cycle:  -1,
+				Events: make([]PerformanceEvent, 0),
+			})
+		}
+		b := &list[i]
+		b.NBakingRights += v.NBakingRights
+		b.NEndorsingRights += v.NEndorsingRights
+		b.NLostBakes += v.NLostBakes
+		b.NStolenBakes += v.NStolenBakes
+		b.NMissedEndorsements += v.NMissedEndorsements
+		b.NMissedSeeds += v.NMissedSeeds
+		b.ExpectedIncome += v.ExpectedIncome
+		b.TotalIncome += v.TotalIncome
+		b.TotalLoss += v.TotalLoss
+		b.EndorsingLoss += v.EndorsingLoss
+		b.SeedLoss += v.SeedLoss
+		b.Events = append(b.Events, v.Events...)
+	}
+	for i := range list {
+		if list[i].ExpectedIncome > 0 {
+			list[i].PerformancePct = list[i].TotalIncome * 100 / list[i].ExpectedIncome
+		}
+	}
+	return list
+}
+
+func (r PerformanceReport) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// WriteTable writes per cycle and per baker summaries followed by a list
+// of all events.
+func (r PerformanceReport) WriteTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "Performance cycles %d-%d at height %d\n\n", r.StartCycle, r.EndCycle, r.Height)
+	fmt.Fprintln(tw, "Cycle\tBaker\tBake\tEndorse\tLost\tStolen\tMissed\tSeeds\tPerf%\tIncome\tLoss\t")
+	for _, v := range r.Cycles {
+		writePerfRow(tw, fmt.Sprint(v.Cycle), v)
+	}
+	for _, v := range r.Bakers() {
+		writePerfRow(tw, "total", v)
+	}
+	fmt.Fprintln(tw, "\t\t\t\t\t\t\t\t\t\t\t")
+	fmt.Fprintln(tw, "Cycle\tHeight\tTime\tBaker\tEvent\tLoss\tOther\t")
+	for _, e := range r.Events() {
+		var other string
+		if e.Other.IsValid() {
+			other = e.Other.String()
+		}
+		fmt.Fprintf(tw, "%d\t%d\t%s\t%s\t%s\t%.6f\t%s\t\n",
+			e.Cycle,
+			e.Height,
+			e.Time.Format(time.RFC3339),
+			e.Baker,
+			e.Type,
+			e.Loss,
+			other,
+		)
+	}
+	return tw.Flush()
+}
+
+func writePerfRow(w io.Writer, cycle string, v CyclePerformance) {
+	fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\t%d\t%d\t%.2f\t%.6f\t%.6f\t\n",
+		cycle,
+		v.Baker,
+		v.NBakingRights,
+		v.NEndorsingRights,
+		v.NLostBakes,
+		v.NStolenBakes,
+		v.NMissedEndorsements,
+		v.NMissedSeeds,
+		v.PerformancePct,
+		v.TotalIncome,
+		v.TotalLoss,
+	)
+}
@@ -42,10 +42,7 @@ type CycleRights struct {
 }
 
 func isSet(buf []byte, i int) bool {
-	if i < 0 || i >= len(buf)*8 {
-		return false
-	}
-	return (buf[i>>3] & byte(1<<uint(i&0x7))) > 0
+	return Bitset(buf).IsSet(i)
 }
 
 func (r CycleRights) Pos(height int64) int {
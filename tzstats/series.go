@@ -0,0 +1,246 @@
+// Copyright (c) 2020-2023 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package tzstats
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+const year = 365 * 24 * time.Hour
+
+// SeriesPoint is a single sample of a time series, values are in the
+// order of Series.Columns.
+type SeriesPoint struct {
+	Time   time.Time `json:"time"`
+	Height int64     `json:"height"`
+	Cycle  int64     `json:"cycle"`
+	Values []float64 `json:"values"`
+}
+
+// Series is a client-side time series of numeric table columns such as
+// the cumulative counters in Chain or Supply rows.
+type Series struct {
+	Columns []string      `json:"columns"`
+	Points  []SeriesPoint `json:"points"`
+}
+
+// NewSeries extracts columns from a slice of table rows (e.g. []*Chain or
+// []*Supply). Columns are referenced by their JSON names and must be
+// numeric. Rows must provide time, height and cycle fields.
+func NewSeries(rows interface{}, cols ...string) (*Series, error) {
+	val := reflect.ValueOf(rows)
+	if val.Kind() != reflect.Slice {
+		return nil, fmt.Errorf("series: expected slice, got %T", rows)
+	}
+	s := &Series{
+		Columns: cols,
+		Points:  make([]SeriesPoint, 0, val.Len()),
+	}
+	if val.Len() == 0 {
+		return s, nil
+	}
+	tinfo, err := GetTypeInfo(reflect.Indirect(val.Index(0)).Interface())
+	if err != nil {
+		return nil, err
+	}
+	fields := make(map[string]*FieldInfo)
+	for i := range tinfo.Fields {
+		fields[tinfo.Fields[i].Alias] = &tinfo.Fields[i]
+	}
+	for _, n := range append([]string{"time", "height", "cycle"}, cols...) {
+		if _, ok := fields[n]; !ok {
+			return nil, fmt.Errorf("series: unknown column %q in %s", n, tinfo.Name)
+		}
+	}
+	for i, l := 0, val.Len(); i < l; i++ {
+		row := reflect.Indirect(val.Index(i))
+		p := SeriesPoint{
+			Time:   fields["time"].Value(row).Interface().(time.Time),
+			Height: fields["height"].Value(row).Int(),
+			Cycle:  fields["cycle"].Value(row).Int(),
+			Values: make([]float64, len(cols)),
+		}
+		for k, n := range cols {
+			f := fields[n].Value(row)
+			switch f.Kind() {
+			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+				p.Values[k] = float64(f.Int())
+			case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+				p.Values[k] = float64(f.Uint())
+			case reflect.Float32, reflect.Float64:
+				p.Values[k] = f.Float()
+			default:
+				return nil, fmt.Errorf("series: column %q is not numeric", n)
+			}
+		}
+		s.Points = append(s.Points, p)
+	}
+	return s, nil
+}
+
+func (s Series) Len() int {
+	return len(s.Points)
+}
+
+// Column returns all values of a column.
+func (s Series) Column(name string) []float64 {
+	idx := colIndex(s.Columns, name)
+	if idx < 0 {
+		return nil
+	}
+	vals := make([]float64, len(s.Points))
+	for i, p := range s.Points {
+		vals[i] = p.Values[idx]
+	}
+	return vals
+}
+
+// Resample keeps the last point in each interval of length d. Point times
+// are set to the interval start. Use on cumulative counters before Deltas
+// to get per-interval values.
+func (s Series) Resample(d time.Duration) Series {
+	return s.resample(func(p SeriesPoint) (int64, time.Time) {
+		t := p.Time.Truncate(d)
+		return t.UnixNano(), t
+	})
+}
+
+// ResampleCycle keeps the last point of each cycle.
+func (s Series) ResampleCycle() Series {
+	return s.resample(func(p SeriesPoint) (int64, time.Time) {
+		return p.Cycle, p.Time
+	})
+}
+
+func (s Series) resample(key func(SeriesPoint) (int64, time.Time)) Series {
+	res := Series{
+		Columns: s.Columns,
+		Points:  make([]SeriesPoint, 0),
+	}
+	var last int64
+	for i, p := range s.Points {
+		k, t := key(p)
+		p.Time = t
+		if i > 0 && k == last {
+			res.Points[len(res.Points)-1] = p
+			continue
+		}
+		last = k
+		res.Points = append(res.Points, p)
+	}
+	return res
+}
+
+// Deltas returns differences between consecutive points. The first point
+// is dropped since it has no predecessor.
+func (s Series) Deltas() Series {
+	res := Series{
+		Columns: s.Columns,
+		Points:  make([]SeriesPoint, 0, len(s.Points)),
+	}
+	for i := 1; i < len(s.Points); i++ {
+		prev, p := s.Points[i-1], s.Points[i]
+		d := SeriesPoint{
+			Time:   p.Time,
+			Height: p.Height,
+			Cycle:  p.Cycle,
+			Values: make([]float64, len(p.Values)),
+		}
+		for k := range p.Values {
+			d.Values[k] = p.Values[k] - prev.Values[k]
+		}
+		res.Points = append(res.Points, d)
+	}
+	return res
+}
+
+// Rates returns deltas between consecutive points normalized to a change
+// per unit of time, e.g. ops per day with per = 24h.
+func (s Series) Rates(per time.Duration) Series {
+	res := s.Deltas()
+	for i := range res.Points {
+		elapsed := s.Points[i+1].Time.Sub(s.Points[i].Time)
+		if elapsed <= 0 {
+			continue
+		}
+		scale := float64(per) / float64(elapsed)
+		for k := range res.Points[i].Values {
+			res.Points[i].Values[k] *= scale
+		}
+	}
+	return res
+}
+
+// Growth returns relative changes between consecutive points annualized
+// to a yearly rate, e.g. inflation from Supply total.
+func (s Series) Growth() Series {
+	res := s.Deltas()
+	for i := range res.Points {
+		prev := s.Points[i]
+		elapsed := s.Points[i+1].Time.Sub(prev.Time)
+		for k := range res.Points[i].Values {
+			if elapsed <= 0 || prev.Values[k] == 0 {
+				res.Points[i].Values[k] = 0
+				continue
+			}
+			res.Points[i].Values[k] *= float64(year) / float64(elapsed) / prev.Values[k]
+		}
+	}
+	return res
+}
+
+// ChainSeries loads chain table rows between from and to and returns
+// a series of the selected cumulative counters.
+func (c *Client) ChainSeries(ctx context.Context, from, to time.Time, cols ...string) (*Series, error) {
+	q := c.NewChainQuery()
+	q.Columns = append([]string{"row_id", "time", "height", "cycle"}, cols...)
+	q.WithFilter(FilterModeRange, "time", from.Format(time.RFC3339), to.Format(time.RFC3339))
+	rows := make([]*Chain, 0)
+	for {
+		list, err := q.Run(ctx)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, list.Rows...)
+		if list.Len() < q.Limit {
+			break
+		}
+		q.WithCursor(list.Cursor())
+	}
+	return NewSeries(rows, cols...)
+}
+
+// SupplySeries loads supply table rows between from and to and returns
+// a series of the selected columns.
+func (c *Client) SupplySeries(ctx context.Context, from, to time.Time, cols ...string) (*Series, error) {
+	q := c.NewSupplyQuery()
+	q.Columns = append([]string{"row_id", "time", "height", "cycle"}, cols...)
+	q.WithFilter(FilterModeRange, "time", from.Format(time.RFC3339), to.Format(time.RFC3339))
+	rows := make([]*Supply, 0)
+	for {
+		list, err := q.Run(ctx)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, list.Rows...)
+		if list.Len() < q.Limit {
+			break
+		}
+		q.WithCursor(list.Cursor())
+	}
+	return NewSeries(rows, cols...)
+}
+
+// InflationSeries returns annualized supply growth per interval d.
+func (c *Client) InflationSeries(ctx context.Context, from, to time.Time, d time.Duration) (*Series, error) {
+	s, err := c.SupplySeries(ctx, from, to, "total")
+	if err != nil {
+		return nil, err
+	}
+	res := s.Resample(d).Growth()
+	return &res, nil
+}
@@ -0,0 +1,274 @@
+// Copyright (c) 2020-2023 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package tzstats
+
+import (
+	"context"
+	"sort"
+
+	"blockwatch.cc/tzgo/tezos"
+)
+
+// StakeSnapshot contains all rows of the selected snapshot for a cycle.
+type StakeSnapshot struct {
+	Cycle  int64       `json:"cycle"`
+	Height int64       `json:"height"`
+	Index  int64       `json:"index"`
+	Rows   []*Snapshot `json:"rows"`
+}
+
+// BakerStake is the stake distribution of a single baker. Gini and
+// Nakamoto describe the concentration of delegated balances.
+type BakerStake struct {
+	Baker       tezos.Address `json:"baker"`
+	IsActive    bool          `json:"is_active"`
+	Own         float64       `json:"own_balance"`
+	Delegated   float64       `json:"delegated_balance"`
+	Staking     float64       `json:"staking_balance"`
+	Share       float64       `json:"share"`
+	NDelegators int           `json:"n_delegators"`
+	Largest     float64       `json:"largest_delegator"`
+	Gini        float64       `json:"gini"`
+	Nakamoto    int           `json:"nakamoto"`
+}
+
+// StakeMove is stake that moved between two bakers across snapshots.
+// Empty addresses denote new or departed delegators.
+type StakeMove struct {
+	From      tezos.Address `json:"from"`
+	To        tezos.Address `json:"to"`
+	Amount    float64       `json:"amount"`
+	NAccounts int           `json:"n_accounts"`
+}
+
+// DelegationChurn compares delegators of two snapshots.
+type DelegationChurn struct {
+	FromCycle int64       `json:"from_cycle"`
+	ToCycle   int64       `json:"to_cycle"`
+	NNew      int         `json:"n_new"`
+	NLeft     int         `json:"n_left"`
+	NMoved    int         `json:"n_moved"`
+	NStayed   int         `json:"n_stayed"`
+	Churn     float64     `json:"churn"` // (left + moved) / delegators in from
+	Moves     []StakeMove `json:"moves"`
+}
+
+// GetStakeSnapshot loads all rows of the snapshot selected for cycle.
+// Additional filters can restrict the result, e.g. to a single baker.
+func (c *Client) GetStakeSnapshot(ctx context.Context, cycle int64, filter FilterList) (*StakeSnapshot, error) {
+	q := c.NewSnapshotQuery()
+	q.Filter = append(q.Filter, filter...)
+	q.WithFilter(FilterModeEqual, "cycle", cycle)
+	q.WithFilter(FilterModeEqual, "is_selected", true)
+	snap := &StakeSnapshot{
+		Cycle: cycle,
+		Rows:  make([]*Snapshot, 0),
+	}
+	for {
+		list, err := q.Run(ctx)
+		if err != nil {
+			return nil, err
+		}
+		snap.Rows = append(snap.Rows, list.Rows...)
+		if list.Len() < q.Limit {
+			break
+		}
+		q.WithCursor(list.Cursor())
+	}
+	if len(snap.Rows) > 0 {
+		snap.Height = snap.Rows[0].Height
+		snap.Index = snap.Rows[0].Index
+	}
+	return snap, nil
+}
+
+// Delegators returns delegator rows keyed by address.
+func (s StakeSnapshot) Delegators() map[string]*Snapshot {
+	m := make(map[string]*Snapshot)
+	for _, v := range s.Rows {
+		if !v.IsBaker {
+			m[v.Address.String()] = v
+		}
+	}
+	return m
+}
+
+// Bakers returns per baker stake distributions sorted by staking balance.
+func (s StakeSnapshot) Bakers() []BakerStake {
+	idx := make(map[string]int)
+	list := make([]BakerStake, 0)
+	balances := make([][]float64, 0)
+	get := func(a tezos.Address) int {
+		key := a.String()
+		i, ok := idx[key]
+		if !ok {
+			i = len(list)
+			idx[key] = i
+			list = append(list, BakerStake{Baker: a})
+			balances = append(balances, nil)
+		}
+		return i
+	}
+	var total float64
+	for _, v := range s.Rows {
+		if v.IsBaker {
+			b := &list[get(v.Address)]
+			b.IsActive = v.IsActive
+			b.Own = v.Balance
+			total += v.Balance
+			continue
+		}
+		i := get(v.Baker)
+		b := &list[i]
+		b.Delegated += v.Balance
+		b.NDelegators++
+		if v.Balance > b.Largest {
+			b.Largest = v.Balance
+		}
+		balances[i] = append(balances[i], v.Balance)
+		total += v.Balance
+	}
+	for i := range list {
+		b := &list[i]
+		b.Staking = b.Own + b.Delegated
+		if total > 0 {
+			b.Share = b.Staking / total
+		}
+		b.Gini = Gini(balances[i])
+		b.Nakamoto = Nakamoto(balances[i], 0.5)
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].Staking > list[j].Staking
+	})
+	return list
+}
+
+// Gini returns the Gini coefficient of the staking balance distribution
+// across bakers.
+func (s StakeSnapshot) Gini() float64 {
+	return Gini(s.stakes())
+}
+
+// Nakamoto returns the minimum number of bakers controlling more than
+// threshold (e.g. 1/3 or 1/2) of total stake.
+func (s StakeSnapshot) Nakamoto(threshold float64) int {
+	return Nakamoto(s.stakes(), threshold)
+}
+
+func (s StakeSnapshot) stakes() []float64 {
+	bakers := s.Bakers()
+	vals := make([]float64, len(bakers))
+	for i, v := range bakers {
+		vals[i] = v.Staking
+	}
+	return vals
+}
+
+// Gini returns the Gini coefficient of vals in [0,1], 0 is equality.
+func Gini(vals []float64) float64 {
+	n := len(vals)
+	if n == 0 {
+		return 0
+	}
+	sorted := make([]float64, n)
+	copy(sorted, vals)
+	sort.Float64s(sorted)
+	var sum, weighted float64
+	for i, v := range sorted {
+		sum += v
+		weighted += float64(i+1) * v
+	}
+	if sum == 0 {
+		return 0
+	}
+	return (2*weighted)/(float64(n)*sum) - float64(n+1)/float64(n)
+}
+
+// Nakamoto returns the minimum number of entries whose sum exceeds
+// threshold times the total.
+func Nakamoto(vals []float64, threshold float64) int {
+	sorted := make([]float64, len(vals))
+	copy(sorted, vals)
+	sort.Sort(sort.Reverse(sort.Float64Slice(sorted)))
+	var total float64
+	for _, v := range sorted {
+		total += v
+	}
+	if total == 0 {
+		return 0
+	}
+	var sum float64
+	for i, v := range sorted {
+		sum += v
+		if sum > total*threshold {
+			return i + 1
+		}
+	}
+	return len(sorted)
+}
+
+// GetDelegationChurn compares delegators between the selected snapshots
+// of two cycles.
+func (c *Client) GetDelegationChurn(ctx context.Context, fromCycle, toCycle int64, filter FilterList) (*DelegationChurn, error) {
+	a, err := c.GetStakeSnapshot(ctx, fromCycle, filter)
+	if err != nil {
+		return nil, err
+	}
+	b, err := c.GetStakeSnapshot(ctx, toCycle, filter)
+	if err != nil {
+		return nil, err
+	}
+	return CompareSnapshots(a, b), nil
+}
+
+// CompareSnapshots computes delegation churn and stake movements between
+// bakers from snapshot a to b. Moves are sorted by amount.
+func CompareSnapshots(a, b *StakeSnapshot) *DelegationChurn {
+	churn := &DelegationChurn{
+		FromCycle: a.Cycle,
+		ToCycle:   b.Cycle,
+		Moves:     make([]StakeMove, 0),
+	}
+	moves := make(map[[2]string]*StakeMove)
+	move := func(from, to tezos.Address, amount float64) {
+		key := [2]string{from.String(), to.String()}
+		m, ok := moves[key]
+		if !ok {
+			m = &StakeMove{From: from, To: to}
+			moves[key] = m
+		}
+		m.Amount += amount
+		m.NAccounts++
+	}
+	prev, next := a.Delegators(), b.Delegators()
+	for key, p := range prev {
+		n, ok := next[key]
+		switch {
+		case !ok:
+			churn.NLeft++
+			move(p.Baker, tezos.Address{}, p.Balance)
+		case !n.Baker.Equal(p.Baker):
+			churn.NMoved++
+			move(p.Baker, n.Baker, n.Balance)
+		default:
+			churn.NStayed++
+		}
+	}
+	for key, n := range next {
+		if _, ok := prev[key]; !ok {
+			churn.NNew++
+			move(tezos.Address{}, n.Baker, n.Balance)
+		}
+	}
+	if l := len(prev); l > 0 {
+		churn.Churn = float64(churn.NLeft+churn.NMoved) / float64(l)
+	}
+	for _, m := range moves {
+		churn.Moves = append(churn.Moves, *m)
+	}
+	sort.SliceStable(churn.Moves, func(i, j int) bool {
+		return churn.Moves[i].Amount > churn.Moves[j].Amount
+	})
+	return churn
+}
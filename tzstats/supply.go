@@ -0,0 +1,214 @@
+// Copyright (c) 2020-2023 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package tzstats
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+type SupplyList struct {
+	Rows    []*Supply
+	columns []string
+}
+
+func (l SupplyList) Len() int {
+	return len(l.Rows)
+}
+
+func (l SupplyList) Cursor() uint64 {
+	if len(l.Rows) == 0 {
+		return 0
+	}
+	return l.Rows[len(l.Rows)-1].RowId
+}
+
+func (l *SupplyList) UnmarshalJSON(data []byte) error {
+	if len(data) == 0 || bytes.Equal(data, null) {
+		return nil
+	}
+	if data[0] != '[' {
+		return fmt.Errorf("SupplyList: expected JSON array")
+	}
+	array := make([]json.RawMessage, 0)
+	if err := json.Unmarshal(data, &array); err != nil {
+		return err
+	}
+	for _, v := range array {
+		r := &Supply{
+			columns: l.columns,
+		}
+		if err := r.UnmarshalJSON(v); err != nil {
+			return err
+		}
+		r.columns = nil
+		l.Rows = append(l.Rows, r)
+	}
+	return nil
+}
+
+func (s *Supply) UnmarshalJSON(data []byte) error {
+	if len(data) == 0 || bytes.Equal(data, null) {
+		return nil
+	}
+	if len(data) == 2 {
+		return nil
+	}
+	if data[0] == '[' {
+		return s.UnmarshalJSONBrief(data)
+	}
+	type Alias *Supply
+	return json.Unmarshal(data, Alias(s))
+}
+
+func (s *Supply) UnmarshalJSONBrief(data []byte) error {
+	supply := Supply{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	unpacked := make([]interface{}, 0)
+	err := dec.Decode(&unpacked)
+	if err != nil {
+		return err
+	}
+	for i, v := range s.columns {
+		f := unpacked[i]
+		if f == nil {
+			continue
+		}
+		switch v {
+		case "row_id":
+			supply.RowId, err = strconv.ParseUint(f.(json.Number).String(), 10, 64)
+		case "height":
+			supply.Height, err = strconv.ParseInt(f.(json.Number).String(), 10, 64)
+		case "cycle":
+			supply.Cycle, err = strconv.ParseInt(f.(json.Number).String(), 10, 64)
+		case "time":
+			var ts int64
+			ts, err = strconv.ParseInt(f.(json.Number).String(), 10, 64)
+			if err == nil {
+				supply.Timestamp = time.Unix(0, ts*1000000).UTC()
+			}
+		case "total":
+			supply.Total, err = f.(json.Number).Float64()
+		case "activated":
+			supply.Activated, err = f.(json.Number).Float64()
+		case "unclaimed":
+			supply.Unclaimed, err = f.(json.Number).Float64()
+		case "circulating":
+			supply.Circulating, err = f.(json.Number).Float64()
+		case "liquid":
+			supply.Liquid, err = f.(json.Number).Float64()
+		case "delegated":
+			supply.Delegated, err = f.(json.Number).Float64()
+		case "staking":
+			supply.Staking, err = f.(json.Number).Float64()
+		case "shielded":
+			supply.Shielded, err = f.(json.Number).Float64()
+		case "active_stake":
+			supply.ActiveStake, err = f.(json.Number).Float64()
+		case "active_delegated":
+			supply.ActiveDelegated, err = f.(json.Number).Float64()
+		case "active_staking":
+			supply.ActiveStaking, err = f.(json.Number).Float64()
+		case "inactive_delegated":
+			supply.InactiveDelegated, err = f.(json.Number).Float64()
+		case "inactive_staking":
+			supply.InactiveStaking, err = f.(json.Number).Float64()
+		case "minted":
+			supply.Minted, err = f.(json.Number).Float64()
+		case "minted_baking":
+			supply.MintedBaking, err = f.(json.Number).Float64()
+		case "minted_endorsing":
+			supply.MintedEndorsing, err = f.(json.Number).Float64()
+		case "minted_seeding":
+			supply.MintedSeeding, err = f.(json.Number).Float64()
+		case "minted_airdrop":
+			supply.MintedAirdrop, err = f.(json.Number).Float64()
+		case "minted_subsidy":
+			supply.MintedSubsidy, err = f.(json.Number).Float64()
+		case "burned":
+			supply.Burned, err = f.(json.Number).Float64()
+		case "burned_double_baking":
+			supply.BurnedDoubleBaking, err = f.(json.Number).Float64()
+		case "burned_double_endorse":
+			supply.BurnedDoubleEndorse, err = f.(json.Number).Float64()
+		case "burned_origination":
+			supply.BurnedOrigination, err = f.(json.Number).Float64()
+		case "burned_allocation":
+			supply.BurnedAllocation, err = f.(json.Number).Float64()
+		case "burned_storage":
+			supply.BurnedStorage, err = f.(json.Number).Float64()
+		case "burned_explicit":
+			supply.BurnedExplicit, err = f.(json.Number).Float64()
+		case "burned_seed_miss":
+			supply.BurnedSeedMiss, err = f.(json.Number).Float64()
+		case "burned_absence":
+			supply.BurnedAbsence, err = f.(json.Number).Float64()
+		case "burned_rollup":
+			supply.BurnedRollup, err = f.(json.Number).Float64()
+		case "frozen":
+			supply.Frozen, err = f.(json.Number).Float64()
+		case "frozen_deposits":
+			supply.FrozenDeposits, err = f.(json.Number).Float64()
+		case "frozen_rewards":
+			supply.FrozenRewards, err = f.(json.Number).Float64()
+		case "frozen_fees":
+			supply.FrozenFees, err = f.(json.Number).Float64()
+		case "frozen_bonds":
+			supply.FrozenBonds, err = f.(json.Number).Float64()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	*s = supply
+	return nil
+}
+
+type SupplyQuery struct {
+	tableQuery
+}
+
+func (c *Client) NewSupplyQuery() SupplyQuery {
+	tinfo, err := GetTypeInfo(&Supply{})
+	if err != nil {
+		panic(err)
+	}
+	q := tableQuery{
+		client:  c,
+		Params:  c.base.Copy(),
+		Table:   "supply",
+		Format:  FormatJSON,
+		Limit:   DefaultLimit,
+		Order:   OrderAsc,
+		Columns: tinfo.Aliases(),
+		Filter:  make(FilterList, 0),
+	}
+	return SupplyQuery{q}
+}
+
+func (q SupplyQuery) Run(ctx context.Context) (*SupplyList, error) {
+	result := &SupplyList{
+		columns: q.Columns,
+	}
+	if err := q.client.QueryTable(ctx, &q.tableQuery, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (c *Client) QuerySupply(ctx context.Context, filter FilterList, cols []string) (*SupplyList, error) {
+	q := c.NewSupplyQuery()
+	if len(cols) > 0 {
+		q.Columns = cols
+	}
+	if len(filter) > 0 {
+		q.Filter = filter
+	}
+	return q.Run(ctx)
+}
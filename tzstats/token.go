@@ -0,0 +1,449 @@
+// Copyright (c) 2020-2023 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package tzstats
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"blockwatch.cc/tzgo/contract"
+	"blockwatch.cc/tzgo/micheline"
+	"blockwatch.cc/tzgo/tezos"
+)
+
+var (
+	// well-known bigmap names in order of preference
+	tokenLedgerNames   = []string{"ledger", "balances", "tokens", "accounts", "balance"}
+	tokenMetadataNames = []string{"token_metadata", "tokens_metadata", "metadata_tokens"}
+	tokenSupplyNames   = []string{"total_supply", "supply", "token_total_supply"}
+)
+
+// Token represents a FA1.2 or FA2 token contract whose ledger, metadata
+// and supply bigmaps have been located from its script.
+type Token struct {
+	Address    tezos.Address
+	Kind       contract.TokenKind
+	LedgerId   int64
+	MetadataId int64
+	SupplyId   int64
+	KeyType    micheline.Type
+	ValueType  micheline.Type
+	IsNFT      bool // ledger maps token id to owner
+
+	client      *Client
+	ownerPath   string
+	idPath      string
+	balancePath string
+}
+
+// TokenTransfer is a single token movement extracted from a transfer call.
+type TokenTransfer struct {
+	Token   tezos.Address `json:"token"`
+	TokenId tezos.Z       `json:"token_id"`
+	From    tezos.Address `json:"from"`
+	To      tezos.Address `json:"to"`
+	Amount  tezos.Z       `json:"amount"`
+}
+
+// TokenActivity groups transfers and ledger balance updates caused by
+// a single contract call.
+type TokenActivity struct {
+	OpHash    tezos.OpHash            `json:"op"`
+	OpId      uint64                  `json:"op_id"`
+	Height    int64                   `json:"height"`
+	Time      time.Time               `json:"time"`
+	Sender    tezos.Address           `json:"sender"`
+	Transfers []TokenTransfer         `json:"transfers"`
+	Balances  []contract.TokenBalance `json:"balances"`
+}
+
+// DetectTokenKind returns the token standard a contract implements based
+// on interfaces detected by the indexer or, when missing, on entrypoints.
+func DetectTokenKind(cc *Contract, eps micheline.Entrypoints) contract.TokenKind {
+	if cc != nil {
+		ifaces := make(micheline.Interfaces, 0, len(cc.Interfaces))
+		for _, v := range cc.Interfaces {
+			ifaces = append(ifaces, micheline.Interface(v))
+		}
+		switch {
+		case ifaces.Contains(micheline.ITzip12):
+			return contract.TokenKindFA2
+		case ifaces.Contains(micheline.ITzip7):
+			return contract.TokenKindFA1_2
+		}
+	}
+	if len(eps) > 0 {
+		switch {
+		case micheline.ITzip12.Matches(eps):
+			return contract.TokenKindFA2
+		case micheline.ITzip7.Matches(eps):
+			return contract.TokenKindFA1_2
+		}
+	}
+	return contract.TokenKindInvalid
+}
+
+// NewToken loads contract and script info for addr, detects its token
+// standard and locates the ledger bigmap.
+func (c *Client) NewToken(ctx context.Context, addr tezos.Address) (*Token, error) {
+	cc, err := c.GetContract(ctx, addr, NewContractParams())
+	if err != nil {
+		return nil, err
+	}
+	script, err := c.loadCachedContractScript(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	eps, _ := script.Script.Entrypoints(true)
+	t := &Token{
+		Address: addr,
+		Kind:    DetectTokenKind(cc, eps),
+		client:  c,
+	}
+	if !t.Kind.IsValid() {
+		return nil, fmt.Errorf("token %s: contract implements neither FA1.2 nor FA2", addr)
+	}
+	names := cc.Bigmaps
+	if len(names) == 0 {
+		names = script.BigmapNames
+	}
+	t.MetadataId = findBigmap(names, tokenMetadataNames)
+	t.SupplyId = findBigmap(names, tokenSupplyNames)
+	if err := t.findLedger(names, script.BigmapTypesById); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Interface returns the token standard interface implemented by t.
+func (t *Token) Interface() micheline.Interface {
+	if t.Kind == contract.TokenKindFA2 {
+		return micheline.ITzip12
+	}
+	return micheline.ITzip7
+}
+
+func findBigmap(names map[string]int64, candidates []string) int64 {
+	for _, n := range candidates {
+		if id, ok := names[n]; ok {
+			return id
+		}
+	}
+	return 0
+}
+
+func (t *Token) findLedger(names map[string]int64, types map[int64]micheline.Type) error {
+	// prefer well-known names, then fall back to a key type match
+	if id := findBigmap(names, tokenLedgerNames); id > 0 {
+		if typ, ok := types[id]; ok && t.useLedger(id, typ) {
+			return nil
+		}
+	}
+	ids := make([]int64, 0, len(types))
+	for id := range types {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		if id == t.MetadataId || id == t.SupplyId {
+			continue
+		}
+		if t.useLedger(id, types[id]) {
+			return nil
+		}
+	}
+	return fmt.Errorf("token %s: no ledger bigmap found", t.Address)
+}
+
+func (t *Token) useLedger(id int64, typ micheline.Type) bool {
+	key, val := typ.Left(), typ.Right()
+	var owner, tokenId, balance string
+	switch key.OpCode {
+	case micheline.T_ADDRESS:
+		// FA1.2 and single-asset FA2 ledgers
+		if t.Kind == contract.TokenKindFA2 && val.OpCode == micheline.T_ADDRESS {
+			return false
+		}
+	case micheline.T_NAT:
+		// NFT ledgers map token id to owner
+		if t.Kind != contract.TokenKindFA2 || val.OpCode != micheline.T_ADDRESS {
+			return false
+		}
+		t.IsNFT = true
+	case micheline.T_PAIR:
+		if t.Kind != contract.TokenKindFA2 || len(key.Args) != 2 {
+			return false
+		}
+		l, r := key.Left(), key.Right()
+		switch {
+		case l.OpCode == micheline.T_ADDRESS && r.OpCode == micheline.T_NAT:
+			owner, tokenId = typeLabel(l, 0), typeLabel(r, 1)
+		case l.OpCode == micheline.T_NAT && r.OpCode == micheline.T_ADDRESS:
+			tokenId, owner = typeLabel(l, 0), typeLabel(r, 1)
+		default:
+			return false
+		}
+	default:
+		return false
+	}
+	if !t.IsNFT {
+		switch val.OpCode {
+		case micheline.T_NAT:
+		case micheline.T_PAIR:
+			// first nat field is the balance, e.g. (pair (nat %balance) (map %approvals ..))
+			balance = "-"
+			for i, v := range val.Args {
+				if v.OpCode == micheline.T_NAT {
+					balance = typeLabel(micheline.NewType(v), i)
+					break
+				}
+			}
+			if balance == "-" {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	t.LedgerId = id
+	t.KeyType, t.ValueType = key, val
+	t.ownerPath, t.idPath, t.balancePath = owner, tokenId, balance
+	return true
+}
+
+func typeLabel(typ micheline.Type, pos int) string {
+	if l := typ.Label(); l != "" {
+		return l
+	}
+	return strconv.Itoa(pos)
+}
+
+// ledgerKey returns the literal key or expression hash used to look up
+// an owner's balance in the ledger bigmap.
+func (t *Token) ledgerKey(owner tezos.Address, id tezos.Z) (string, error) {
+	switch t.KeyType.OpCode {
+	case micheline.T_ADDRESS:
+		return owner.String(), nil
+	case micheline.T_NAT:
+		return id.String(), nil
+	}
+	a, n := micheline.NewBytes(owner.EncodePadded()), micheline.NewNat(id.Big())
+	prim := micheline.NewPair(a, n)
+	if t.KeyType.Left().OpCode == micheline.T_NAT {
+		prim = micheline.NewPair(n, a)
+	}
+	key, err := micheline.NewKey(t.KeyType, prim)
+	if err != nil {
+		return "", err
+	}
+	return key.Hash().String(), nil
+}
+
+func (t *Token) decodeBalance(v BigmapValue, removed bool) (contract.TokenBalance, bool) {
+	bal := contract.TokenBalance{
+		Token: t.Address,
+	}
+	if t.IsNFT {
+		id, ok := v.Key.GetBig("")
+		if !ok || removed {
+			return bal, false
+		}
+		bal.TokenId = tezos.NewBigZ(id)
+		bal.Owner, ok = v.GetAddress("")
+		bal.Balance = tezos.NewZ(1)
+		return bal, ok
+	}
+	var ok bool
+	bal.Owner, ok = v.Key.GetAddress(t.ownerPath)
+	if !ok {
+		return bal, false
+	}
+	if t.idPath != "" {
+		id, ok := v.Key.GetBig(t.idPath)
+		if !ok {
+			return bal, false
+		}
+		bal.TokenId = tezos.NewBigZ(id)
+	}
+	if !removed {
+		bal.Balance, ok = v.GetZ(t.balancePath)
+	}
+	return bal, ok
+}
+
+// GetBalance returns the balance of owner for token id (ignored on FA1.2).
+func (t *Token) GetBalance(ctx context.Context, owner tezos.Address, id tezos.Z) (tezos.Z, error) {
+	key, err := t.ledgerKey(owner, id)
+	if err != nil {
+		return tezos.Zero, err
+	}
+	v, err := t.client.GetBigmapValue(ctx, t.LedgerId, key, NewContractParams())
+	if err != nil {
+		if ErrorStatus(err) == http.StatusNotFound {
+			return tezos.Zero, nil
+		}
+		return tezos.Zero, err
+	}
+	bal, ok := t.decodeBalance(*v, false)
+	if !ok {
+		return tezos.Zero, fmt.Errorf("token %s: cannot decode ledger value for %s", t.Address, key)
+	}
+	if t.IsNFT && !bal.Owner.Equal(owner) {
+		return tezos.Zero, nil
+	}
+	return bal.Balance, nil
+}
+
+// ListHolders walks the ledger bigmap and returns all non-zero balances
+// for token id (ignored on FA1.2). All pages are read at the current tip
+// so that ledger updates in between do not skip or repeat holders.
+func (t *Token) ListHolders(ctx context.Context, id tezos.Z) ([]contract.TokenBalance, error) {
+	tip, err := t.client.GetTip(ctx)
+	if err != nil {
+		return nil, err
+	}
+	params := NewContractParams().
+		WithBlock(strconv.FormatInt(tip.Height, 10)).
+		WithLimit(DefaultPageSize)
+	holders := make([]contract.TokenBalance, 0)
+	for offset := uint(0); ; offset += DefaultPageSize {
+		vals, err := t.client.ListBigmapValues(ctx, t.LedgerId, params.WithOffset(offset))
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range vals {
+			bal, ok := t.decodeBalance(v, false)
+			if !ok || bal.Balance.IsZero() {
+				continue
+			}
+			if t.Kind == contract.TokenKindFA2 && !bal.TokenId.Equal(id) {
+				continue
+			}
+			holders = append(holders, bal)
+		}
+		if uint(len(vals)) < DefaultPageSize {
+			break
+		}
+	}
+	return holders, nil
+}
+
+// GetTotalSupply returns total supply for token id from a supply bigmap
+// or storage field when present, otherwise sums all ledger balances. Token
+// ids without supply bigmap entry fall back to the ledger sum.
+func (t *Token) GetTotalSupply(ctx context.Context, id tezos.Z) (tezos.Z, error) {
+	if t.SupplyId > 0 {
+		v, err := t.client.GetBigmapValue(ctx, t.SupplyId, id.String(), NewContractParams())
+		switch {
+		case err == nil:
+			if supply, ok := v.GetZ(""); ok {
+				return supply, nil
+			}
+		case ErrorStatus(err) != http.StatusNotFound:
+			return tezos.Zero, err
+		}
+	}
+	if t.Kind == contract.TokenKindFA1_2 {
+		store, err := t.client.GetContractStorage(ctx, t.Address, NewContractParams())
+		if err != nil {
+			return tezos.Zero, err
+		}
+		for _, n := range []string{"total_supply", "totalSupply", "supply"} {
+			if supply, ok := store.GetZ(n); ok {
+				return supply, nil
+			}
+		}
+	}
+	holders, err := t.ListHolders(ctx, id)
+	if err != nil {
+		return tezos.Zero, err
+	}
+	supply := tezos.Zero
+	for _, v := range holders {
+		supply = supply.Add(v.Balance)
+	}
+	return supply, nil
+}
+
+// GetMetadata reads TZIP-12 token metadata for token id from the
+// token_metadata bigmap.
+func (t *Token) GetMetadata(ctx context.Context, id tezos.Z) (*contract.TokenMetadata, error) {
+	if t.MetadataId == 0 {
+		return nil, fmt.Errorf("token %s: missing token metadata bigmap", t.Address)
+	}
+	v, err := t.client.GetBigmapValue(ctx, t.MetadataId, id.String(), NewContractParams().WithPrim())
+	if err != nil {
+		return nil, err
+	}
+	if v.ValuePrim == nil {
+		return nil, fmt.Errorf("token %s/%s: missing metadata value", t.Address, id)
+	}
+	meta := &contract.TokenMetadata{}
+	if err := meta.UnmarshalPrim(*v.ValuePrim); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// ListTransfers walks all calls to the token contract matching params and
+// returns decoded transfers together with resulting ledger balances.
+func (t *Token) ListTransfers(ctx context.Context, params ContractParams) ([]TokenActivity, error) {
+	list := make([]TokenActivity, 0)
+	var cursor uint64
+	for {
+		params = params.WithLimit(DefaultPageSize).WithCursor(cursor)
+		calls, err := t.client.ListContractCalls(ctx, t.Address, params)
+		if err != nil {
+			return nil, err
+		}
+		for _, op := range calls {
+			if act, ok := t.decodeActivity(op); ok {
+				list = append(list, act)
+			}
+		}
+		if uint(len(calls)) < DefaultPageSize {
+			break
+		}
+		cursor = calls[len(calls)-1].Cursor()
+	}
+	return list, nil
+}
+
+func (t *Token) decodeActivity(op *Op) (TokenActivity, bool) {
+	act := TokenActivity{
+		OpHash: op.Hash,
+		OpId:   op.Id,
+		Height: op.Height,
+		Time:   op.Timestamp,
+		Sender: op.Sender,
+	}
+	for _, o := range op.Content() {
+		if !o.IsSuccess || !o.Receiver.Equal(t.Address) {
+			continue
+		}
+		if o.Parameters != nil && o.Parameters.Entrypoint == "transfer" {
+			xfers, err := decodeTokenTransfers(t.Address, t.Interface(), o.Parameters)
+			if err == nil {
+				act.Transfers = append(act.Transfers, xfers...)
+			}
+		}
+		for _, upd := range o.BigmapDiff {
+			if upd.BigmapId != t.LedgerId {
+				continue
+			}
+			switch upd.Action {
+			case micheline.DiffActionUpdate, micheline.DiffActionRemove:
+				bal, ok := t.decodeBalance(upd.BigmapValue, upd.Action == micheline.DiffActionRemove)
+				if ok {
+					act.Balances = append(act.Balances, bal)
+				}
+			}
+		}
+	}
+	return act, len(act.Transfers) > 0 || len(act.Balances) > 0
+}
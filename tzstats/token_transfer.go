@@ -0,0 +1,130 @@
+// Copyright (c) 2020-2023 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package tzstats
+
+import (
+	"context"
+	"encoding/json"
+
+	"blockwatch.cc/tzgo/contract"
+	"blockwatch.cc/tzgo/micheline"
+	"blockwatch.cc/tzgo/tezos"
+)
+
+// TransferInterface returns the token standard whose transfer entrypoint
+// type matches ep or an empty interface when ep is not a token transfer.
+func TransferInterface(ep micheline.Entrypoint) micheline.Interface {
+	if ep.Name != "transfer" || ep.Prim == nil {
+		return ""
+	}
+	for _, iface := range []micheline.Interface{
+		micheline.ITzip12,
+		micheline.ITzip7,
+		micheline.ITzip5,
+	} {
+		if iface.Contains(ep) {
+			return iface
+		}
+	}
+	return ""
+}
+
+// DecodeTokenTransfers returns a flat list of FA1.2 and FA2 transfers
+// contained in ops including their batch and internal contents. Contracts
+// are identified by matching the called entrypoint type against token
+// standards, so any compliant contract is supported. Scripts are loaded
+// through the client's script cache.
+func (c *Client) DecodeTokenTransfers(ctx context.Context, ops ...*Op) ([]TokenTransfer, error) {
+	xfers := make([]TokenTransfer, 0)
+	ifaces := make(map[string]micheline.Interface)
+	for _, op := range ops {
+		for _, o := range op.Content() {
+			if !o.IsSuccess || o.Type != OpTypeTransaction || o.Parameters == nil {
+				continue
+			}
+			if o.Parameters.Entrypoint != "transfer" || !o.Receiver.IsContract() {
+				continue
+			}
+			key := o.Receiver.String()
+			iface, ok := ifaces[key]
+			if !ok {
+				script, err := c.loadCachedContractScript(ctx, o.Receiver)
+				if err != nil {
+					return nil, err
+				}
+				eps, err := script.Script.Entrypoints(true)
+				if err != nil {
+					return nil, err
+				}
+				iface = TransferInterface(eps["transfer"])
+				ifaces[key] = iface
+			}
+			if iface == "" {
+				continue
+			}
+			list, err := decodeTokenTransfers(o.Receiver, iface, o.Parameters)
+			if err != nil {
+				return nil, err
+			}
+			xfers = append(xfers, list...)
+		}
+	}
+	return xfers, nil
+}
+
+// decodeTokenTransfers unpacks transfer call arguments using the standard
+// entrypoint type so that field names do not depend on contract annotations.
+func decodeTokenTransfers(token tezos.Address, iface micheline.Interface, params *ContractParameters) ([]TokenTransfer, error) {
+	var buf []byte
+	if params.Prim != nil && params.Prim.IsValid() {
+		val := micheline.NewValue(iface.TypeOf("transfer"), *params.Prim)
+		m, err := val.Map()
+		if err != nil {
+			return nil, err
+		}
+		if buf, err = json.Marshal(m); err != nil {
+			return nil, err
+		}
+	} else {
+		// the API may or may not wrap call arguments into the entrypoint name
+		val := params.Value
+		if m, ok := val.(map[string]interface{}); !ok || m["transfer"] == nil {
+			val = map[string]interface{}{"transfer": val}
+		}
+		var err error
+		if buf, err = json.Marshal(val); err != nil {
+			return nil, err
+		}
+	}
+
+	xfers := make([]TokenTransfer, 0)
+	switch iface {
+	case micheline.ITzip12:
+		var list contract.FA2TransferList
+		if err := json.Unmarshal(buf, &list); err != nil {
+			return nil, err
+		}
+		for _, v := range list {
+			xfers = append(xfers, TokenTransfer{
+				Token:   token,
+				TokenId: v.TokenId,
+				From:    v.From,
+				To:      v.To,
+				Amount:  v.Amount,
+			})
+		}
+	case micheline.ITzip7, micheline.ITzip5:
+		var x contract.FA1Transfer
+		if err := json.Unmarshal(buf, &x); err != nil {
+			return nil, err
+		}
+		xfers = append(xfers, TokenTransfer{
+			Token:  token,
+			From:   x.From,
+			To:     x.To,
+			Amount: x.Amount,
+		})
+	}
+	return xfers, nil
+}
@@ -0,0 +1,258 @@
+// Copyright (c) 2020-2023 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package tzstats
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// FallbackMode defines how a Valuator prices a timestamp for which
+// no candle is available.
+type FallbackMode string
+
+const (
+	FallbackNone    FallbackMode = "none"    // leave the movement unpriced
+	FallbackNearest FallbackMode = "nearest" // use the closest candle before or after
+	FallbackTicker  FallbackMode = "ticker"  // use the current ticker price
+)
+
+// Valuator annotates chain movements with fiat values taken from
+// market candles. Candles for the full time range are fetched once.
+type Valuator struct {
+	Market   string
+	Pair     string
+	Collapse time.Duration
+	Fallback FallbackMode
+	MaxAge   time.Duration // max distance to a candle, zero means one interval
+
+	client  *Client
+	candles CandleList
+	ticker  *Ticker
+	from    time.Time // loaded range
+	to      time.Time
+}
+
+// Price is the fiat price used to value a movement at time Time.
+type Price struct {
+	Time       time.Time `json:"time"`
+	PriceTime  time.Time `json:"price_time"`
+	Price      float64   `json:"price"`
+	IsValid    bool      `json:"is_valid"`
+	IsFallback bool      `json:"is_fallback"`
+}
+
+func (p Price) Value(amount float64) float64 {
+	return amount * p.Price
+}
+
+type OpValue struct {
+	Op     *Op     `json:"op"`
+	Price  Price   `json:"price"`
+	Volume float64 `json:"volume"`
+	Fee    float64 `json:"fee"`
+	Burned float64 `json:"burned"`
+	Reward float64 `json:"reward"`
+}
+
+type LedgerValue struct {
+	Entry  LedgerEntry `json:"entry"`
+	Price  Price       `json:"price"`
+	Debit  float64     `json:"debit"`
+	Credit float64     `json:"credit"`
+}
+
+func (c *Client) NewValuator(market, pair string) *Valuator {
+	return &Valuator{
+		Market:   market,
+		Pair:     pair,
+		Collapse: Collapse1h,
+		Fallback: FallbackNearest,
+		client:   c,
+	}
+}
+
+func (v *Valuator) WithCollapse(d time.Duration) *Valuator {
+	v.Collapse = d
+	return v
+}
+
+func (v *Valuator) WithFallback(m FallbackMode) *Valuator {
+	v.Fallback = m
+	return v
+}
+
+func (v *Valuator) WithMaxAge(d time.Duration) *Valuator {
+	v.MaxAge = d
+	return v
+}
+
+// Load fetches candles covering from and to. Long ranges are loaded in
+// windows of DefaultPageSize candles. Empty candles are dropped so that
+// gaps are handled by the fallback mode.
+func (v *Valuator) Load(ctx context.Context, from, to time.Time) error {
+	if v.Collapse <= 0 {
+		return fmt.Errorf("valuation: invalid collapse interval %s", v.Collapse)
+	}
+	from = from.Truncate(v.Collapse).Add(-v.Collapse)
+	to = to.Truncate(v.Collapse).Add(v.Collapse)
+	var (
+		rows    = make([]Candle, 0)
+		columns []string
+	)
+	for start, end := from, from; end.Before(to); start = end {
+		end = start.Add(DefaultPageSize * v.Collapse)
+		if end.After(to) {
+			end = to
+		}
+		candles, err := v.client.ListCandles(ctx, CandleArgs{
+			Market:   v.Market,
+			Pair:     v.Pair,
+			Collapse: v.Collapse,
+			Fill:     FillModeNone,
+			From:     start,
+			To:       end,
+			Limit:    int(end.Sub(start)/v.Collapse) + 1,
+		})
+		if err != nil {
+			return err
+		}
+		columns = candles.Columns
+		for _, c := range candles.Rows {
+			// window bounds may be inclusive on both ends
+			if c.Timestamp.Before(start) || (len(rows) > 0 && !c.Timestamp.After(rows[len(rows)-1].Timestamp)) {
+				continue
+			}
+			if c.Close > 0 {
+				rows = append(rows, c)
+			}
+		}
+	}
+	v.from, v.to = from, to
+	v.candles.Columns = columns
+	v.candles.Rows = rows
+	if v.Fallback == FallbackTicker {
+		ticker, err := v.client.GetTicker(ctx, v.Market, v.Pair)
+		if err != nil {
+			return err
+		}
+		v.ticker = ticker
+	}
+	return nil
+}
+
+// PriceAt returns the close price of the candle whose interval contains t.
+func (v *Valuator) PriceAt(t time.Time) Price {
+	p := Price{Time: t}
+	maxAge := v.MaxAge
+	if maxAge <= 0 {
+		maxAge = v.Collapse
+	}
+	l := v.candles.Len()
+	// first candle starting after t, the one before covers t
+	idx := sort.Search(l, func(i int) bool { return v.candles.Rows[i].Timestamp.After(t) })
+	if idx > 0 {
+		c := v.candles.Rows[idx-1]
+		if t.Sub(c.Timestamp) < maxAge {
+			p.PriceTime, p.Price, p.IsValid = c.Timestamp, c.Close, true
+			return p
+		}
+	}
+	switch v.Fallback {
+	case FallbackNearest:
+		var best *Candle
+		if idx > 0 {
+			best = &v.candles.Rows[idx-1]
+		}
+		if idx < l {
+			if c := &v.candles.Rows[idx]; best == nil || c.Timestamp.Sub(t) < t.Sub(best.Timestamp) {
+				best = c
+			}
+		}
+		if best != nil {
+			p.PriceTime, p.Price = best.Timestamp, best.Close
+			p.IsValid, p.IsFallback = true, true
+		}
+	case FallbackTicker:
+		if v.ticker != nil {
+			p.PriceTime, p.Price = v.ticker.Time, v.ticker.Last
+			p.IsValid, p.IsFallback = true, true
+		}
+	}
+	return p
+}
+
+// ValueOps loads candles for the time range spanned by ops unless already
+// loaded and returns fiat values for each op content including batch and
+// internal operations.
+func (v *Valuator) ValueOps(ctx context.Context, ops ...*Op) ([]OpValue, error) {
+	list := make([]*Op, 0, len(ops))
+	for _, op := range ops {
+		list = append(list, op.Content()...)
+	}
+	times := make([]time.Time, len(list))
+	for i, o := range list {
+		times[i] = o.Timestamp
+	}
+	if err := v.ensure(ctx, times); err != nil {
+		return nil, err
+	}
+	vals := make([]OpValue, len(list))
+	for i, o := range list {
+		p := v.PriceAt(o.Timestamp)
+		vals[i] = OpValue{
+			Op:     o,
+			Price:  p,
+			Volume: p.Value(o.Volume),
+			Fee:    p.Value(o.Fee),
+			Burned: p.Value(o.Burned),
+			Reward: p.Value(o.Reward),
+		}
+	}
+	return vals, nil
+}
+
+// ValueLedger returns fiat values for each ledger entry.
+func (v *Valuator) ValueLedger(ctx context.Context, entries LedgerEntryList) ([]LedgerValue, error) {
+	times := make([]time.Time, len(entries))
+	for i, e := range entries {
+		times[i] = e.Time
+	}
+	if err := v.ensure(ctx, times); err != nil {
+		return nil, err
+	}
+	vals := make([]LedgerValue, len(entries))
+	for i, e := range entries {
+		p := v.PriceAt(e.Time)
+		vals[i] = LedgerValue{
+			Entry:  e,
+			Price:  p,
+			Debit:  p.Value(e.Debit),
+			Credit: p.Value(e.Credit),
+		}
+	}
+	return vals, nil
+}
+
+// ensure loads candles once when the requested range is not yet covered.
+func (v *Valuator) ensure(ctx context.Context, times []time.Time) error {
+	if len(times) == 0 {
+		return nil
+	}
+	from, to := times[0], times[0]
+	for _, t := range times[1:] {
+		if t.Before(from) {
+			from = t
+		}
+		if t.After(to) {
+			to = t
+		}
+	}
+	if !v.from.IsZero() && !from.Before(v.from) && !to.After(v.to) {
+		return nil
+	}
+	return v.Load(ctx, from, to)
+}
@@ -0,0 +1,253 @@
+// Copyright (c) 2020-2023 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package tzstats
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"blockwatch.cc/tzgo/micheline"
+	"blockwatch.cc/tzgo/tezos"
+)
+
+// ContractView describes an on-chain view of a contract.
+type ContractView struct {
+	Name       string            `json:"name"`
+	Param      micheline.Type    `json:"-"`
+	Retval     micheline.Type    `json:"-"`
+	ParamType  micheline.Typedef `json:"param_type"`
+	ReturnType micheline.Typedef `json:"return_type"`
+}
+
+// ListContractViews returns all on-chain views of a contract sorted by
+// name.
+func (c *Client) ListContractViews(ctx context.Context, addr tezos.Address) ([]ContractView, error) {
+	script, err := c.GetContractScript(ctx, addr, NewContractParams().WithPrim())
+	if err != nil {
+		return nil, err
+	}
+	if script.Script == nil {
+		return nil, fmt.Errorf("contract %s: missing script", addr)
+	}
+	views, err := script.Script.Views(false, false)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]ContractView, 0, len(views))
+	for _, v := range views {
+		list = append(list, ContractView{
+			Name:       v.Name,
+			Param:      v.Param,
+			Retval:     v.Retval,
+			ParamType:  v.Param.Typedef("@params"),
+			ReturnType: v.Retval.Typedef("@return"),
+		})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list, nil
+}
+
+// GetContractView returns a single view by name.
+func (c *Client) GetContractView(ctx context.Context, addr tezos.Address, name string) (*ContractView, error) {
+	views, err := c.ListContractViews(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	for i := range views {
+		if views[i].Name == name {
+			return &views[i], nil
+		}
+	}
+	return nil, fmt.Errorf("contract %s: no view %q", addr, name)
+}
+
+type runViewRequest struct {
+	Contract      tezos.Address  `json:"contract"`
+	View          string         `json:"view"`
+	Input         micheline.Prim `json:"input"`
+	ChainId       string         `json:"chain_id"`
+	UnlimitedGas  bool           `json:"unlimited_gas"`
+	UnparsingMode string         `json:"unparsing_mode"`
+}
+
+type runViewResponse struct {
+	Data micheline.Prim `json:"data"`
+}
+
+// RunView executes an on-chain view at the current head through the node
+// RPC endpoint set with WithNodeUrl and decodes the result with the view's
+// return type. The argument may be a micheline.Prim or a Go value that is
+// encoded using the view's parameter type (see NewViewArg).
+func (c *Client) RunView(ctx context.Context, addr tezos.Address, name string, arg interface{}) (*ContractValue, error) {
+	view, err := c.GetContractView(ctx, addr, name)
+	if err != nil {
+		return nil, err
+	}
+	return c.RunContractView(ctx, addr, *view, arg)
+}
+
+// RunContractView executes a view with known type information, e.g. from
+// ListContractViews, which saves loading the contract script.
+func (c *Client) RunContractView(ctx context.Context, addr tezos.Address, view ContractView, arg interface{}) (*ContractValue, error) {
+	if c.node.Server == "" {
+		return nil, fmt.Errorf("view %s: no node RPC configured, see WithNodeUrl", view.Name)
+	}
+	input, err := NewViewArg(view.Param, arg)
+	if err != nil {
+		return nil, fmt.Errorf("view %s argument: %v", view.Name, err)
+	}
+	chainId, err := c.nodeChainId(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req := runViewRequest{
+		Contract:      addr,
+		View:          view.Name,
+		Input:         input,
+		ChainId:       chainId,
+		UnlimitedGas:  true,
+		UnparsingMode: "Readable",
+	}
+	var resp runViewResponse
+	u := c.node.Url("/chains/main/blocks/head/helpers/scripts/run_script_view")
+	if err := c.post(ctx, u, nil, req, &resp); err != nil {
+		return nil, err
+	}
+	val := micheline.NewValue(view.Retval, resp.Data)
+	m, err := val.Map()
+	if err != nil {
+		return nil, fmt.Errorf("view %s result: %v", view.Name, err)
+	}
+	return &ContractValue{
+		Value: m,
+		Prim:  &resp.Data,
+	}, nil
+}
+
+// nodeChainId returns the chain id of the node RPC endpoint. The result
+// is cached.
+func (c *Client) nodeChainId(ctx context.Context) (string, error) {
+	u := c.node.Url("/chains/main/chain_id")
+	if c.cache != nil {
+		if id, ok := c.cache.Get(u); ok {
+			return id.(string), nil
+		}
+	}
+	var id string
+	if err := c.get(ctx, u, nil, &id); err != nil {
+		return "", err
+	}
+	if c.cache != nil {
+		c.cache.Add(u, id)
+	}
+	return id, nil
+}
+
+// NewViewArg converts a Go value into a Michelson value of type typ. Values
+// of comparable types are accepted like bigmap keys (see NewBigmapKey).
+// Lists and sets accept slices, maps and big maps accept Go maps and
+// lambdas accept a micheline.Prim or Micheline JSON code. A micheline.Prim
+// is used as is at any level.
+func NewViewArg(typ micheline.Type, val interface{}) (micheline.Prim, error) {
+	return encodeValuePrim(typ.Prim, val)
+}
+
+func encodeValuePrim(typ micheline.Prim, val interface{}) (micheline.Prim, error) {
+	if p, ok := val.(micheline.Prim); ok {
+		return p, nil
+	}
+	if p, ok, err := encodeCompositePrim(typ, val, encodeValuePrim); ok {
+		return p, err
+	}
+	switch typ.OpCode {
+	case micheline.T_LIST, micheline.T_SET:
+		rv := reflect.Indirect(reflect.ValueOf(val))
+		switch rv.Kind() {
+		case reflect.Slice, reflect.Array:
+		default:
+			return micheline.Prim{}, fmt.Errorf("%s value requires a slice, got %T", typ.OpCode, val)
+		}
+		elems := make([]micheline.Prim, rv.Len())
+		for i := range elems {
+			p, err := encodeValuePrim(typ.Args[0], rv.Index(i).Interface())
+			if err != nil {
+				return micheline.Prim{}, err
+			}
+			elems[i] = p
+		}
+		if typ.OpCode == micheline.T_SET {
+			sort.SliceStable(elems, func(i, j int) bool {
+				return comparePrim(elems[i], elems[j]) < 0
+			})
+		}
+		return micheline.NewSeq(elems...), nil
+	case micheline.T_MAP, micheline.T_BIG_MAP:
+		rv := reflect.Indirect(reflect.ValueOf(val))
+		if rv.Kind() != reflect.Map {
+			return micheline.Prim{}, fmt.Errorf("%s value requires a map, got %T", typ.OpCode, val)
+		}
+		elems := make([]micheline.Prim, 0, rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			k, err := encodeKeyPrim(typ.Args[0], iter.Key().Interface())
+			if err != nil {
+				return micheline.Prim{}, err
+			}
+			v, err := encodeValuePrim(typ.Args[1], iter.Value().Interface())
+			if err != nil {
+				return micheline.Prim{}, err
+			}
+			elems = append(elems, micheline.NewMapElem(k, v))
+		}
+		// map keys must be sorted
+		sort.Slice(elems, func(i, j int) bool {
+			return comparePrim(elems[i].Args[0], elems[j].Args[0]) < 0
+		})
+		return micheline.NewMap(elems...), nil
+	case micheline.T_LAMBDA:
+		var code micheline.Prim
+		var err error
+		switch v := val.(type) {
+		case string:
+			code, err = micheline.ParsePrim(v)
+		case []byte:
+			code, err = micheline.ParsePrim(string(v))
+		default:
+			return micheline.Prim{}, fmt.Errorf("lambda value requires code, got %T", val)
+		}
+		if err != nil {
+			return micheline.Prim{}, fmt.Errorf("invalid lambda code: %v", err)
+		}
+		return code, nil
+	}
+	return encodeKeyPrim(typ, val)
+}
+
+// comparePrim orders comparable Michelson values as required for set
+// elements and map keys. Opcodes are ordered False < True, Left < Right and
+// None < Some.
+func comparePrim(a, b micheline.Prim) int {
+	switch {
+	case a.Type == micheline.PrimInt && b.Type == micheline.PrimInt:
+		return a.Int.Cmp(b.Int)
+	case a.Type == micheline.PrimString && b.Type == micheline.PrimString:
+		return strings.Compare(a.String, b.String)
+	case a.Type == micheline.PrimBytes && b.Type == micheline.PrimBytes:
+		return bytes.Compare(a.Bytes, b.Bytes)
+	case a.OpCode != b.OpCode:
+		return int(a.OpCode) - int(b.OpCode)
+	}
+	for i := 0; i < len(a.Args) && i < len(b.Args); i++ {
+		if c := comparePrim(a.Args[i], b.Args[i]); c != 0 {
+			return c
+		}
+	}
+	return len(a.Args) - len(b.Args)
+}
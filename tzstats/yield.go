@@ -0,0 +1,182 @@
+// Copyright (c) 2020-2023 Blockwatch Data Inc.
+// Author: alex@blockwatch.cc
+
+package tzstats
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+
+	"blockwatch.cc/tzgo/tezos"
+)
+
+// YieldEstimate is the projected income of delegating Amount tez to Baker.
+// Rates are fractions per cycle or year, rewards are in tez.
+type YieldEstimate struct {
+	Baker             tezos.Address `json:"baker"`
+	Amount            float64       `json:"amount"`
+	Fee               float64       `json:"fee"`
+	Luck              float64       `json:"luck"`
+	Performance       float64       `json:"performance"`
+	StakingBalance    float64       `json:"staking_balance"`
+	StakingCapacity   float64       `json:"staking_capacity"`
+	IsFull            bool          `json:"is_full"`
+	IsOverdelegated   bool          `json:"is_overdelegated"` // after adding Amount
+	IsActive          bool          `json:"is_active"`
+	CycleReward       float64       `json:"cycle_reward"`
+	CycleRate         float64       `json:"cycle_rate"`
+	AnnualReward      float64       `json:"annual_reward"`
+	AnnualRate        float64       `json:"annual_rate"`  // simple
+	AnnualYield       float64       `json:"annual_yield"` // compounded per cycle
+	CyclesPerYear     float64       `json:"cycles_per_year"`
+	NetworkCycleRate  float64       `json:"network_cycle_rate"`
+	NetworkAnnualRate float64       `json:"network_annual_rate"`
+}
+
+// YieldEstimator projects delegation rewards from protocol reward
+// parameters, network stake and historic baker statistics.
+type YieldEstimator struct {
+	Config            *BlockchainConfig
+	ActiveStake       float64 // network active stake in tez
+	CycleRewards      float64 // total network rewards per cycle in tez
+	CyclesPerYear     float64
+	DefaultFee        float64 // used when a baker has no fee metadata
+	IgnoreLuck        bool    // use expected instead of historic luck
+	IgnorePerformance bool    // assume 100% performance
+}
+
+func (c *Client) NewYieldEstimator(ctx context.Context) (*YieldEstimator, error) {
+	config, err := c.GetConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tip, err := c.GetTip(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if tip.Supply == nil {
+		return nil, fmt.Errorf("yield: missing supply data")
+	}
+	return NewYieldEstimator(config, tip.Supply.ActiveStake)
+}
+
+func NewYieldEstimator(config *BlockchainConfig, activeStake float64) (*YieldEstimator, error) {
+	if config.BlocksPerCycle == 0 || activeStake <= 0 {
+		return nil, fmt.Errorf("yield: invalid config or stake")
+	}
+	e := &YieldEstimator{
+		Config:      config,
+		ActiveStake: activeStake,
+	}
+	var perBlock float64
+	if config.BakingRewardFixedPortion > 0 {
+		// Tenderbake: fixed + max bonus + all endorsing slots (mutez)
+		bonusSlots := config.ConsensusCommitteeSize - config.ConsensusThreshold
+		perBlock = fromMutez(config.BakingRewardFixedPortion +
+			config.BakingRewardBonusPerSlot*int64(bonusSlots) +
+			config.EndorsingRewardPerSlot*int64(config.ConsensusCommitteeSize))
+	} else {
+		perBlock = config.BlockReward + config.EndorsementReward*float64(config.EndorsersPerBlock)
+	}
+	e.CycleRewards = perBlock * float64(config.BlocksPerCycle)
+
+	delay := config.MinimalBlockDelay
+	if delay == 0 && config.TimeBetweenBlocks != nil {
+		delay = config.TimeBetweenBlocks[0]
+	}
+	if delay > 0 {
+		e.CyclesPerYear = 365 * 86400 / float64(int64(delay)*config.BlocksPerCycle)
+	}
+	return e, nil
+}
+
+// NetworkCycleRate is the expected reward per tez of active stake and cycle.
+func (e YieldEstimator) NetworkCycleRate() float64 {
+	return e.CycleRewards / e.ActiveStake
+}
+
+// Estimate projects income for delegating amount tez to b. Luck and
+// performance are taken from the baker's 64 cycle averages when present
+// (in 1/100 percent like the API reports them) and the fee from its
+// metadata. When amount would exceed the baker's staking capacity
+// rewards are diluted accordingly.
+func (e YieldEstimator) Estimate(b *Baker, amount float64) YieldEstimate {
+	est := YieldEstimate{
+		Baker:            b.Address,
+		Amount:           amount,
+		Fee:              e.DefaultFee,
+		Luck:             1,
+		Performance:      1,
+		StakingBalance:   b.StakingBalance,
+		StakingCapacity:  b.StakingCapacity,
+		IsFull:           b.IsFull,
+		IsActive:         b.IsActive,
+		CyclesPerYear:    e.CyclesPerYear,
+		NetworkCycleRate: e.NetworkCycleRate(),
+	}
+	est.NetworkAnnualRate = est.NetworkCycleRate * e.CyclesPerYear
+	if b.Metadata != nil && b.Metadata.Has("baker") {
+		// an explicit zero fee is valid
+		est.Fee = b.Metadata.Baker().Fee
+	}
+	if b.Stats != nil {
+		if !e.IgnoreLuck && b.Stats.AvgLuck64 > 0 {
+			est.Luck = float64(b.Stats.AvgLuck64) / 10000
+		}
+		if !e.IgnorePerformance && b.Stats.AvgPerformance64 > 0 {
+			est.Performance = math.Min(float64(b.Stats.AvgPerformance64)/10000, 1)
+		}
+	}
+	if !b.IsActive {
+		return est
+	}
+
+	// only stake within capacity earns rewards which are shared by all
+	staking := b.StakingBalance + amount
+	active := staking
+	if b.StakingCapacity > 0 && staking > b.StakingCapacity {
+		active = b.StakingCapacity
+		est.IsOverdelegated = true
+	}
+	if staking <= 0 {
+		return est
+	}
+	est.CycleRate = est.NetworkCycleRate * est.Luck * est.Performance * active / staking * (1 - est.Fee)
+	est.CycleReward = amount * est.CycleRate
+	est.AnnualRate = est.CycleRate * e.CyclesPerYear
+	est.AnnualReward = amount * est.AnnualRate
+	est.AnnualYield = math.Pow(1+est.CycleRate, e.CyclesPerYear) - 1
+	return est
+}
+
+// RankBakers estimates yields for all bakers returned by ListBakers with
+// metadata and statistics and sorts them by descending annual rate.
+// Inactive bakers and bakers that do not accept delegations are skipped.
+func (c *Client) RankBakers(ctx context.Context, amount float64, params BakerParams) ([]YieldEstimate, error) {
+	e, err := c.NewYieldEstimator(ctx)
+	if err != nil {
+		return nil, err
+	}
+	bakers, err := c.ListBakers(ctx, params.WithMeta().WithStats())
+	if err != nil {
+		return nil, err
+	}
+	list := make([]YieldEstimate, 0, len(bakers))
+	for _, b := range bakers {
+		if !b.IsActive {
+			continue
+		}
+		if b.Metadata != nil {
+			if m := b.Metadata.Baker(); m != nil && m.NonDelegatable {
+				continue
+			}
+		}
+		list = append(list, e.Estimate(b, amount))
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].AnnualRate > list[j].AnnualRate
+	})
+	return list, nil
+}